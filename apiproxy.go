@@ -1,52 +1,84 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/inominate/apicache"
-	"github.com/inominate/ratelimit"
+	"github.com/inominate/eve-api-proxy/apiproxy"
 )
 
-var debugLog *log.Logger
-var debug bool
+// The config file in use, reloaded on SIGHUP.
+var configFileName = "apiproxy.xml"
 
-var dc *DiskCache
+// Debug logging asked for on the command line stays on across reloads.
+var debugFlag bool
 
-var rateLimiter *ratelimit.RateLimit
-var errorRateLimiter *ratelimit.RateLimit
+// Closed once shutdown has finished and the proxy may exit.
+var shutdownDone = make(chan struct{})
 
 func main() {
 	var err error
 	log.SetFlags(0)
 
-	conf, err = loadConfig("apiproxy.xml")
-
-	var newConfig bool
+	var newConfig, showConfig, fastStart bool
+	var mockAddr, mockFixtures string
+	var recordFile, replayFile string
 	// Check and process command line flags
+	flag.StringVar(&configFileName, "config", configFileName, "Config file to use.")
 	flag.BoolVar(&newConfig, "create", false, "Create new config file from detaults.")
-	flag.BoolVar(&conf.Logging.Debug, "debug", conf.Logging.Debug, "Enable debug logging.")
-	flag.BoolVar(&conf.FastStart, "q", conf.FastStart, "Fast startup, delete existing cache instead of loading it.")
+	flag.BoolVar(&showConfig, "print-config", false, "Print the configuration in use, including environment overrides, and exit.")
+	flag.BoolVar(&debugFlag, "debug", false, "Enable debug logging.")
+	flag.BoolVar(&fastStart, "q", false, "Fast startup, delete existing cache instead of loading it.")
+	flag.StringVar(&recordFile, "record", "", "Record API requests to this replay archive.")
+	flag.StringVar(&replayFile, "replay", "", "Answer requests from this replay archive instead of the API.")
+	flag.StringVar(&mockAddr, "mock", "", "Run a mock API on this address instead of the proxy.")
+	flag.StringVar(&mockFixtures, "mock-fixtures", "", "Directory of XML files served by the mock API.")
 	flag.Parse()
 	//////////////////////////////////////
 
+	if mockAddr != "" {
+		runMock(mockAddr, mockFixtures)
+		return
+	}
+
 	if newConfig {
 		createConfig()
 	}
 
+	conf, err := apiproxy.LoadConfig(configFileName)
 	if err != nil {
 		log.Fatalf("Error loading configuration: %s", err)
 	}
 
-	debug = conf.Logging.Debug
-	setupLogging()
+	// Only override FastStart when -q was actually given.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "q" {
+			conf.FastStart = fastStart
+		}
+	})
+	if recordFile != "" {
+		conf.Replay = apiproxy.ReplayConfig{Record: recordFile}
+	}
+	if replayFile != "" {
+		conf.Replay = apiproxy.ReplayConfig{Replay: replayFile, Timing: conf.Replay.Timing}
+	}
+
+	conf.Logging.Debug = conf.Logging.Debug || debugFlag
+
+	if showConfig {
+		printConfig(conf)
+		return
+	}
 
 	// We do everything in UTC/evetime.
 	time.Local = time.UTC
@@ -56,81 +88,163 @@ func main() {
 		conf.Threads = runtime.NumCPU()
 	}
 	runtime.GOMAXPROCS(conf.Threads)
-	log.Printf("EVEAPIProxy Starting Up with %d threads...", conf.Threads)
-	//////////////////////////////////////
 
-	// Initialize and configure the apicache module.
-	log.Printf("Initializing Disk Cache...")
-	dc = NewDiskCache(conf.CacheDir, conf.FastStart)
-	log.Printf("Done.")
+	server, err := apiproxy.NewServer(apiproxy.WithConfig(conf))
+	if err != nil {
+		log.Fatal(err)
+	}
+	apicache.DebugLog = server.DebugLogger()
+	server.Logger().Printf("EVEAPIProxy Starting Up with %d threads...", conf.Threads)
 
-	apicache.NewClient(dc)
-	apicache.SetMaxIdleConns(conf.Workers)
-	// We do our own retrying, we don't want the apicache to do them for us.
-	apicache.GetDefaultClient().Retries = 0
-	apicache.GetDefaultClient().SetTimeout(time.Duration(conf.APITimeout) * time.Second)
+	server.Start()
+	startConfigWatcher(server)
+	go handleSignals(server)
 
-	ua := "eve-api-proxy by Innominate - http://github.com/inominate/eve-api-proxy"
-	if conf.UserAgent != "" {
-		ua = conf.UserAgent
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatalf("Error starting api proxy: %s", err)
 	}
-	apicache.GetDefaultClient().UserAgent = ua
-	//////////////////////////////////////
+	<-shutdownDone
+}
 
-	errorRateLimiter = ratelimit.NewRateLimit(conf.MaxErrors, time.Duration(conf.ErrorPeriod)*time.Second)
-	rateLimiter = ratelimit.NewRateLimit(conf.RequestsPerSecond, time.Second)
+// Runs the mock API on addr until killed.
+func runMock(addr, fixtures string) {
+	log.SetFlags(log.Ldate | log.Ltime)
+	apicache.DebugLog = log.New(ioutil.Discard, "", 0)
 
-	startWorkers()
+	log.Printf("Mock API listening on %s.", addr)
+	if fixtures != "" {
+		log.Printf("Serving fixtures from %s.", fixtures)
+	}
 
-	// Fire up the http server
-	var handler APIMux
-	server := http.Server{
-		Addr:         conf.Listen,
-		Handler:      &handler,
-		ReadTimeout:  70 * time.Second,
-		WriteTimeout: 70 * time.Second,
+	server := &http.Server{
+		Addr:    addr,
+		Handler: apiproxy.NewMockServer(fixtures, log.New(os.Stdout, "", log.Ldate|log.Ltime)),
 	}
+	log.Fatal(server.ListenAndServe())
+}
 
-	err = server.ListenAndServe()
-	fmt.Printf("Error stating api proxy: %s", err)
-	log.Fatal(err)
+func createConfig() {
+	c := apiproxy.DefaultConfig()
+	// Secret for the control API
+	c.Secret = apiproxy.NewSecret()
+	data, err := apiproxy.EncodeConfig(apiproxy.ConfigFormat(configFileName), c)
+	if err != nil {
+		log.Fatalf("Error creating config: %s", err)
+	}
+
+	filename := configFileName + ".default"
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		log.Fatalf("Error creating config file %s: %s", filename, err)
+	} else {
+		log.Fatalf("Created new config file %s", filename)
+	}
 }
 
-func setupLogging() {
-	var logfp io.Writer
-	var debugfp io.Writer
-	var err error
+// Prints the configuration in use, after environment overrides and with its
+// secrets blanked, in the same format as the config file.
+func printConfig(c apiproxy.Config) {
+	data, err := apiproxy.EncodeConfig(apiproxy.ConfigFormat(configFileName), c.Redacted())
+	if err != nil {
+		log.Fatalf("Error printing config: %s", err)
+	}
+	fmt.Println(string(data))
+}
+
+// Loads the config file again and applies whatever can be changed while
+// running. A config that fails to load leaves everything as it was.
+func reloadConfig(server *apiproxy.Server) error {
+	newConfig, err := apiproxy.LoadConfig(configFileName)
+	if err != nil {
+		return err
+	}
+	newConfig.Logging.Debug = newConfig.Logging.Debug || debugFlag
+	if newConfig.Threads == 0 {
+		newConfig.Threads = runtime.NumCPU()
+	}
+
+	err = server.Reload(newConfig)
+	if err != nil {
+		return err
+	}
+	runtime.GOMAXPROCS(newConfig.Threads)
+
+	server.Logger().Printf("Configuration reloaded from %s.", configFileName)
+	return nil
+}
+
+// Reloads the config whenever its file changes, checking every interval.
+func watchConfig(server *apiproxy.Server, interval time.Duration) {
+	var lastMod time.Time
+	if info, err := os.Stat(configFileName); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	for {
+		time.Sleep(interval)
 
-	logfp = os.Stdout
-	debugfp = ioutil.Discard
-	logflag := log.Ldate | log.Ltime
+		info, err := os.Stat(configFileName)
+		if err != nil || !info.ModTime().After(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
 
-	if conf.Logging.LogFile != "" {
-		logfp, err = os.OpenFile(conf.Logging.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		err = reloadConfig(server)
 		if err != nil {
-			log.Fatalf("Cannot Open Log File: %s", err)
+			server.Logger().Printf("Config reload failed, keeping current config: %s", err)
 		}
 	}
-	log.SetOutput(logfp)
-
-	if debug {
-		if conf.Logging.DebugLogFile != conf.Logging.LogFile {
-			if conf.Logging.DebugLogFile == "" {
-				debugfp = os.Stdout
-			} else {
-				debugfp, err = os.OpenFile(conf.Logging.DebugLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-				if err != nil {
-					log.Fatalf("Cannot Open Debug Log File: %s", err)
-				}
+}
+
+func startConfigWatcher(server *apiproxy.Server) {
+	interval := server.Config().WatchConfig
+	if interval <= 0 {
+		return
+	}
+	server.Logger().Printf("Watching %s for changes every %d seconds.", configFileName, interval)
+	go watchConfig(server, time.Duration(interval)*time.Second)
+}
+
+// SIGHUP reloads the config, which also reopens the log files so external
+// rotation works. SIGTERM and SIGINT shut down gracefully, a second one exits
+// right away.
+func handleSignals(server *apiproxy.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	logger := server.Logger()
+	shuttingDown := false
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			logger.Printf("SIGHUP received, reloading configuration.")
+			err := reloadConfig(server)
+			if err != nil {
+				logger.Printf("Config reload failed, keeping current config: %s", err)
+				server.ReopenLogs()
 			}
-		} else {
-			debugfp = logfp
+			continue
+		}
+
+		if shuttingDown {
+			logger.Printf("%s received again, exiting immediately.", sig)
+			os.Exit(1)
 		}
+		shuttingDown = true
+		logger.Printf("%s received.", sig)
+		go shutdown(server)
 	}
+}
+
+// Shuts the server down, giving it conf.ShutdownTimeout to finish what it's
+// doing.
+func shutdown(server *apiproxy.Server) {
+	timeout := time.Duration(server.Config().ShutdownTimeout) * time.Second
+	server.Logger().Printf("Shutting down, waiting up to %s for requests to finish...", timeout)
 
-	debugLog = log.New(debugfp, "DEBUG ", logflag)
-	apicache.DebugLog = debugLog
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	log.SetFlags(logflag)
-	debugLog.SetFlags(logflag)
+	server.Shutdown(ctx)
+	close(shutdownDone)
 }
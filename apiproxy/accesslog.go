@@ -0,0 +1,183 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+func validateLogging(c LogConfig) error {
+	switch strings.ToLower(c.Format) {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("Unknown Logging.Format %s", c.Format)
+	}
+	if c.MaxSize < 0 || c.MaxAge < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("Logging.MaxSize, MaxAge and MaxBackups can't be negative")
+	}
+	if c.AccessLogFile != "" && (c.AccessLogFile == c.LogFile || c.AccessLogFile == c.DebugLogFile) {
+		return fmt.Errorf("Logging.AccessLogFile %s is already used by LogFile or DebugLogFile", c.AccessLogFile)
+	}
+	for _, f := range c.Fields {
+		if !accessLogFields[f] {
+			return fmt.Errorf("Unknown Logging.Field %s", f)
+		}
+	}
+	return nil
+}
+
+// Hides most of a vCode when censor is set.
+func censorParam(key, value string, censor bool) string {
+	if censor && strings.ToLower(key) == "vcode" {
+		if len(value) > 8 {
+			return value[0:8] + "..."
+		}
+		return "..."
+	}
+	return value
+}
+
+// Parameters fit for logging, censored and without the proxy's own.
+func logParamMap(params map[string]string, censor bool) map[string]string {
+	logParams := make(map[string]string)
+	for k, v := range params {
+		if proxyParams[k] {
+			continue
+		}
+		logParams[k] = censorParam(k, v, censor)
+	}
+	return logParams
+}
+
+// Formats parameters as a query string for the text logs.
+func formatLogParams(params map[string]string, censor bool) string {
+	logParams := logParamMap(params, censor)
+
+	keys := make([]string, 0, len(logParams))
+	for k := range logParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + logParams[k]
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "?" + strings.Join(pairs, "&")
+}
+
+// Finds a parameter regardless of how the client capitalized it.
+func findParam(params map[string]string, key string) string {
+	for k, v := range params {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// One request in the JSON access log. Field names are relied upon by log
+// pipelines so must not change.
+type accessLogEntry struct {
+	Time            time.Time         `json:"time"`
+	RemoteAddr      string            `json:"remoteAddr"`
+	Client          string            `json:"client,omitempty"`
+	Upstream        string            `json:"upstream,omitempty"`
+	Endpoint        string            `json:"endpoint"`
+	Params          map[string]string `json:"params,omitempty"`
+	KeyID           string            `json:"keyID,omitempty"`
+	HTTPCode        int               `json:"httpCode"`
+	APIErrorCode    int               `json:"apiErrorCode,omitempty"`
+	APIErrorText    string            `json:"apiErrorText,omitempty"`
+	CacheStatus     string            `json:"cacheStatus,omitempty"`
+	WorkerID        string            `json:"workerID,omitempty"`
+	Retries         int               `json:"retries"`
+	UpstreamLatency float64           `json:"upstreamLatency"`
+	Duration        float64           `json:"duration"`
+	Expires         *time.Time        `json:"expires,omitempty"`
+}
+
+// Names of the fields in the JSON access log.
+var accessLogFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(accessLogEntry{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		fields[name] = true
+	}
+	return fields
+}()
+
+// Cuts an encoded entry down to fields, in their order. Fields the entry
+// omitted stay omitted.
+func selectLogFields(data []byte, fields []string) ([]byte, error) {
+	var all map[string]json.RawMessage
+	err := json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for _, f := range fields {
+		value, ok := all[f]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (s *Server) logRequestJSON(conf *Config, remoteAddr, url string, params map[string]string, resp *apicache.Response, result reqResult, startTime time.Time) {
+	entry := accessLogEntry{
+		Time:       time.Now(),
+		RemoteAddr: remoteAddr,
+		Client:     params["client"],
+		Upstream:   params["upstream"],
+		Endpoint:   url,
+		Params:     logParamMap(params, conf.Logging.CensorLog),
+		KeyID:      findParam(params, "keyid"),
+		Duration:   time.Since(startTime).Seconds(),
+	}
+
+	if resp == nil {
+		entry.HTTPCode = 404
+		entry.APIErrorText = "Invalid Request"
+	} else {
+		entry.HTTPCode = resp.HTTPCode
+		entry.APIErrorCode = resp.Error.ErrorCode
+		entry.APIErrorText = resp.Error.ErrorText
+		entry.CacheStatus = result.cacheStatus
+		entry.WorkerID = result.workerID
+		entry.Retries = result.retries
+		entry.UpstreamLatency = result.latency.Seconds()
+		entry.Expires = &resp.Expires
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil && len(conf.Logging.Fields) > 0 {
+		data, err = selectLogFields(data, conf.Logging.Fields)
+	}
+	if err != nil {
+		s.log.Printf("Unknown JSON Marshal Error: %s", err)
+		return
+	}
+	s.accessLog.Print(string(data))
+}
@@ -0,0 +1,105 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONAccessLogOwnOutput(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Logging.Format = "json"
+	conf.Logging.LogRequests = true
+	conf.Logging.Fields = []string{"endpoint", "keyID", "httpCode", "upstream"}
+
+	logOutput := &bytes.Buffer{}
+	accessOutput := &bytes.Buffer{}
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)),
+		WithLogOutput(logOutput), WithAccessLogOutput(accessOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Logger().Printf("General message")
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nope.xml.aspx?keyID=1&vCode=abcdefghijkl", nil))
+
+	expected := `{"endpoint":"/nope.xml.aspx","keyID":"1","httpCode":404}` + "\n"
+	if accessOutput.String() != expected {
+		t.Errorf("Access log got %q, expected %q", accessOutput.String(), expected)
+	}
+	if !strings.Contains(logOutput.String(), "General message") || strings.Contains(logOutput.String(), "{") {
+		t.Errorf("General log got %q", logOutput.String())
+	}
+}
+
+func TestJSONAccessLogCacheStatus(t *testing.T) {
+	var forwarded string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = req.FormValue("worker")
+		now := time.Now().UTC()
+		fmt.Fprintf(w, `<?xml version='1.0' encoding='UTF-8'?>
+<eveapi version="2"><currentTime>%s</currentTime><result /><cachedUntil>%s</cachedUntil></eveapi>`,
+			now.Format("2006-01-02 15:04:05"), now.Add(time.Hour).Format("2006-01-02 15:04:05"))
+	}))
+	defer api.Close()
+
+	conf := DefaultConfig()
+	conf.Workers = 1
+	conf.Logging.Format = "json"
+	conf.Logging.LogRequests = true
+	conf.Logging.Fields = []string{"params", "cacheStatus", "workerID"}
+	conf.Upstreams = []UpstreamConfig{{Name: "test", BaseURL: api.URL, PathPrefix: "/test"}}
+
+	accessOutput := &bytes.Buffer{}
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)),
+		WithLogOutput(&bytes.Buffer{}), WithAccessLogOutput(accessOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer shutdownTestServer(t, s)
+
+	// Parameters named like the log fields are the client's own, passed on
+	// and logged as such.
+	for _, expected := range []string{"miss", "hit"} {
+		accessOutput.Reset()
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/account/characters.xml.aspx?worker=x&cachestatus=y", nil))
+
+		var entry struct {
+			Params      map[string]string `json:"params"`
+			CacheStatus string            `json:"cacheStatus"`
+			WorkerID    string            `json:"workerID"`
+		}
+		if err := json.Unmarshal(accessOutput.Bytes(), &entry); err != nil {
+			t.Fatalf("Bad access log entry %q: %s", accessOutput.String(), err)
+		}
+		if entry.CacheStatus != expected || entry.WorkerID == "x" || entry.WorkerID == "" {
+			t.Errorf("Access log has cache status %q and worker %q, expected %q", entry.CacheStatus, entry.WorkerID, expected)
+		}
+		if entry.Params["worker"] != "x" || entry.Params["cachestatus"] != "y" {
+			t.Errorf("Access log lost the client's params: %v", entry.Params)
+		}
+	}
+	if forwarded != "x" {
+		t.Errorf("Upstream got worker param %q, expected the client's", forwarded)
+	}
+}
+
+func TestValidateLogFields(t *testing.T) {
+	for _, c := range []LogConfig{
+		{Fields: []string{"endpoint", "vCode"}},
+		{LogFile: "proxy.log", AccessLogFile: "proxy.log"},
+	} {
+		if err := validateLogging(c); err == nil {
+			t.Errorf("Invalid logging %+v accepted", c)
+		}
+	}
+	if err := validateLogging(LogConfig{Fields: []string{"time", "endpoint", "cacheStatus"}}); err != nil {
+		t.Errorf("Valid fields refused: %s", err)
+	}
+}
@@ -0,0 +1,117 @@
+package apiproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// An authentication failure along with the API error to report.
+type authError struct {
+	code int
+	text string
+}
+
+func (e *authError) Error() string {
+	return e.text
+}
+
+// Finds the access token for a request and checks it may use the page. The
+// token is removed from params so it's never sent to the API. Returns a nil
+// token if authentication isn't required.
+func authenticate(conf *Config, req *http.Request, url string, params map[string]string) (*AccessToken, *authError) {
+	auth := conf.Auth
+
+	var given string
+	if auth.Param != "" {
+		given = params[auth.Param]
+		delete(params, auth.Param)
+	}
+	if auth.Header != "" && req.Header.Get(auth.Header) != "" {
+		given = req.Header.Get(auth.Header)
+	}
+
+	if !auth.Required {
+		return nil, nil
+	}
+	if given == "" {
+		return nil, &authError{401, "APIProxy Error: Access token required."}
+	}
+
+	var token *AccessToken
+	for i := range auth.Tokens {
+		t := &auth.Tokens[i]
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(given)) == 1 {
+			token = t
+		}
+	}
+
+	if token == nil {
+		return nil, &authError{403, "APIProxy Error: Invalid access token."}
+	}
+	if token.Disabled {
+		return token, &authError{403, "APIProxy Error: Access token disabled."}
+	}
+	if !token.allows(url) {
+		return token, &authError{403, "APIProxy Error: Access token not allowed to use this page."}
+	}
+	return token, nil
+}
+
+// The stats pages name clients and tokens, so while tokens are required they
+// need a token allowed every page or the control secret.
+func statsAllowed(conf *Config, req *http.Request) bool {
+	if !conf.Auth.Required || hasSecret(conf, req) {
+		return true
+	}
+	_, authErr := authenticate(conf, req, "", makeParams(req))
+	return authErr == nil
+}
+
+// Tokens without any prefixes may use every page.
+func (t *AccessToken) allows(url string) bool {
+	if len(t.Allow) == 0 {
+		return true
+	}
+
+	url = strings.ToLower(url)
+	for _, prefix := range t.Allow {
+		if strings.HasPrefix(url, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAuth(a AuthConfig) error {
+	if a.Required && a.Header == "" && a.Param == "" {
+		return fmt.Errorf("Auth.Header or Auth.Param needed to require access tokens")
+	}
+
+	names := make(map[string]bool)
+	for _, t := range a.Tokens {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("Auth.Token name %q missing or duplicated", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.Token == "" {
+			return fmt.Errorf("Auth.Token %s has no token", t.Name)
+		}
+
+		for _, prefix := range t.Allow {
+			matched := false
+			for page := range validPages {
+				if strings.HasPrefix(page, strings.ToLower(prefix)) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("Auth.Token %s Allow %s matches no API page", t.Name, prefix)
+			}
+		}
+	}
+	return nil
+}
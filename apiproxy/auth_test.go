@@ -0,0 +1,75 @@
+package apiproxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAuthTestServer(t *testing.T, output *bytes.Buffer) *Server {
+	conf := DefaultConfig()
+	conf.Secret = "controlsecret"
+	conf.Logging.Debug = true
+	conf.Logging.LogRequests = true
+	conf.Auth.Required = true
+	conf.Auth.Tokens = []AccessToken{
+		{Name: "full", Token: "fulltoken"},
+		{Name: "limited", Token: "limitedtoken", Allow: []string{"/eve/"}},
+	}
+
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)), WithLogOutput(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStatsNeedAuth(t *testing.T) {
+	s := newAuthTestServer(t, &bytes.Buffer{})
+
+	for _, page := range []string{"/stats", "/stats.json", "/metrics"} {
+		for _, tc := range []struct {
+			header, value string
+			code          int
+		}{
+			{"", "", 403},
+			{"X-Proxy-Token", "wrongtoken", 403},
+			{"X-Proxy-Token", "limitedtoken", 403},
+			{"X-Proxy-Token", "fulltoken", 200},
+			{controlSecretHeader, "controlsecret", 200},
+		} {
+			req := httptest.NewRequest("GET", page, nil)
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			if w.Code != tc.code {
+				t.Errorf("%s with %s %q got HTTP %d, expected %d", page, tc.header, tc.value, w.Code, tc.code)
+			}
+			if w.Code != 200 && strings.Contains(w.Body.String(), "limited") {
+				t.Errorf("%s refused but named a token: %s", page, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestDebugLogRedacted(t *testing.T) {
+	output := &bytes.Buffer{}
+	s := newAuthTestServer(t, output)
+
+	req := httptest.NewRequest("GET", "/nope.xml.aspx?keyID=1&vCode=abcdefghijklmnop&proxytoken=fulltoken", nil)
+	req.Header.Set("X-Proxy-Token", "fulltoken")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	logged := output.String()
+	if !strings.Contains(logged, "Invalid Request for /nope.xml.aspx?keyID=1&vCode=abcdefgh...") {
+		t.Errorf("Invalid request not logged as expected: %s", logged)
+	}
+	for _, secret := range []string{"fulltoken", "abcdefghijklmnop"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("Debug log contains %s: %s", secret, logged)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package apiproxy
+
+import (
+	neturl "net/url"
+	"strings"
+	"sync"
+)
+
+// Describes the request a cache entry answers so that entries can be purged
+// by what they hold: the page followed by its parameters as a sorted query
+// string, along with the upstream for named upstreams. Keys are stored in the
+// clear, so vCodes are censored.
+func cacheKey(upstream, url string, params map[string]string) string {
+	values := make(neturl.Values)
+	for k, v := range params {
+		if !proxyParams[k] {
+			values.Set(k, censorParam(k, v, true))
+		}
+	}
+	if upstream != "" {
+		values.Set("upstream", upstream)
+	}
+	return url + "?" + values.Encode()
+}
+
+// Builds a match for PurgeMatching accepting entries for page, or for every
+// page under it when it ends in /, that have each of params. A blank page
+// matches any page, an upstream param of "" the default upstream. Pages and
+// parameter names are matched regardless of case. Entries without a key never
+// match.
+func keyMatcher(page string, params map[string]string) func(key string) bool {
+	page = strings.ToLower(page)
+
+	return func(key string) bool {
+		i := strings.Index(key, "?")
+		if i < 0 {
+			return false
+		}
+
+		keyPage := strings.ToLower(key[:i])
+		switch {
+		case page == "":
+		case strings.HasSuffix(page, "/"):
+			if !strings.HasPrefix(keyPage, page) {
+				return false
+			}
+		case keyPage != page:
+			return false
+		}
+
+		values, err := neturl.ParseQuery(key[i+1:])
+		if err != nil {
+			return false
+		}
+		keyParams := make(map[string]string)
+		for k, v := range values {
+			keyParams[k] = v[0]
+		}
+		for k, v := range params {
+			if findParam(keyParams, k) != v {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Keys for the requests the workers are sending upstream, by the tag their
+// responses will be stored under, so the cache apicache stores them through
+// can keep the key with the entry.
+type storeKeys struct {
+	keys map[string]*storeKey
+	sync.Mutex
+}
+
+type storeKey struct {
+	key  string
+	refs int
+}
+
+func newStoreKeys() *storeKeys {
+	return &storeKeys{keys: make(map[string]*storeKey)}
+}
+
+// Makes key available for tag until the returned function is called.
+func (k *storeKeys) expect(tag, key string) func() {
+	k.Lock()
+	defer k.Unlock()
+
+	sk, ok := k.keys[tag]
+	if !ok {
+		sk = &storeKey{key: key}
+		k.keys[tag] = sk
+	}
+	sk.refs++
+
+	return func() {
+		k.Lock()
+		defer k.Unlock()
+
+		sk.refs--
+		if sk.refs == 0 {
+			delete(k.keys, tag)
+		}
+	}
+}
+
+func (k *storeKeys) get(tag string) (string, bool) {
+	k.Lock()
+	defer k.Unlock()
+
+	sk, ok := k.keys[tag]
+	if !ok {
+		return "", false
+	}
+	return sk.key, true
+}
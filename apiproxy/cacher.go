@@ -0,0 +1,690 @@
+package apiproxy
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var prefixes = "0123456789abcdef"
+
+// CacheBackend is the storage used by apicache for API responses. Anything
+// satisfying it can be handed to apicache.NewClient.
+//
+// Backends keep entries for a retention period past their expiration and
+// keep returning them from Get, so that stale data can be served when
+// allowed. Callers must check Expires themselves.
+type CacheBackend interface {
+	Store(cacheTag string, HTTPCode int, data []byte, Expires time.Time) error
+	Get(cacheTag string) (int, []byte, time.Time, error)
+	LogStats(w io.Writer)
+}
+
+// EncodedCache is implemented by backends that can hand back a body still
+// compressed as stored, avoiding a decompress and recompress when the client
+// accepts the same encoding.
+type EncodedCache interface {
+	// Returns the stored body if it is in the given encoding and the entry
+	// expires at Expires.
+	GetEncoded(cacheTag string, encoding string, Expires time.Time) ([]byte, error)
+}
+
+// KeyedCache is implemented by backends that can keep the key describing the
+// request an entry answers alongside it, see cacheKey.
+type KeyedCache interface {
+	StoreKeyed(cacheTag string, key string, HTTPCode int, data []byte, Expires time.Time) error
+}
+
+// PurgeableCache is implemented by backends that can drop entries on demand.
+type PurgeableCache interface {
+	// Removes the entry for cacheTag. Returns the number removed, or -1 if
+	// unknown.
+	Purge(cacheTag string) (int, error)
+
+	// Removes every entry whose key match accepts, entries stored without a
+	// key are given a blank one. Returns the number removed.
+	PurgeMatching(match func(key string) bool) (int, error)
+}
+
+// ClosableCache is implemented by backends with work to finish before the
+// proxy exits.
+type ClosableCache interface {
+	// Waits for writes in progress, stops accepting new ones and stops any
+	// background cleanup.
+	Close() error
+}
+
+// Returns the cache backend selected in the configuration, logging to logger
+// and debugLog.
+func NewCacheBackend(c Config, logger, debugLog *log.Logger) (CacheBackend, error) {
+	switch strings.ToLower(c.CacheBackend) {
+	case "", "disk":
+		limits := CacheLimits{c.MaxCacheBytes, c.MaxCacheEntries, c.EvictionPolicy}
+		encoding, err := parseEncoding(c.CacheCompression)
+		if err != nil {
+			return nil, err
+		}
+		return NewDiskCache(c.CacheDir, c.FastStart, limits, encoding, staleRetention(c), logger, debugLog)
+	case "memory":
+		return NewMemoryCache(c.MemoryCacheEntries, staleRetention(c), debugLog), nil
+	case "redis":
+		return NewRedisCache(c.RedisAddr, c.RedisPassword, c.RedisDB, c.RedisPrefix, staleRetention(c), logger, debugLog)
+	}
+	return nil, fmt.Errorf("Unknown cache backend %s", c.CacheBackend)
+}
+
+type CacheEntry struct {
+	HTTPCode int
+	Expires  time.Time
+	// Describes the request the entry answers, blank if unknown.
+	Key string `json:",omitempty"`
+
+	// Used for eviction, Size is the number of bytes used on disk.
+	Size       int64
+	LastAccess time.Time
+	Hits       int64
+}
+
+type DiskCache struct {
+	cacheRoot  string
+	cacheFiles map[string]CacheEntry
+	cacheBytes int64
+
+	limits    CacheLimits
+	evictions int64
+
+	// Compression used for newly stored entries.
+	encoding byte
+
+	// How long to keep entries past their expiration.
+	retain time.Duration
+
+	// Set once the proxy is shutting down, stores are dropped.
+	closed bool
+	// Closed along with the cache to stop the expired entry purger.
+	done chan struct{}
+
+	log      *log.Logger
+	debugLog *log.Logger
+
+	sync.RWMutex
+}
+
+// Eviction state isn't part of the records, it is saved here on Close so a
+// restart doesn't forget which entries are in use.
+const cacheIndexFile = "index.json"
+
+type cacheIndexEntry struct {
+	LastAccess time.Time
+	Hits       int64
+}
+
+// Must be called with the lock held.
+func (d *DiskCache) saveIndex() error {
+	index := make(map[string]cacheIndexEntry, len(d.cacheFiles))
+	for tag, ce := range d.cacheFiles {
+		index[tag] = cacheIndexEntry{ce.LastAccess, ce.Hits}
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.cacheRoot+"/"+cacheIndexFile, data)
+}
+
+// Reads and removes the saved eviction state, which only describes the cache
+// as it was at the last clean shutdown.
+func (d *DiskCache) loadIndex() map[string]cacheIndexEntry {
+	filename := d.cacheRoot + "/" + cacheIndexFile
+	index := make(map[string]cacheIndexEntry)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return index
+	}
+	os.Remove(filename)
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		d.log.Printf("Ignoring unreadable cache index: %s", err)
+	}
+	return index
+}
+
+func (d *DiskCache) init() error {
+	d.Lock()
+	defer d.Unlock()
+
+	os.Mkdir(d.cacheRoot, 0770)
+	index := d.loadIndex()
+
+	migrated := 0
+	for _, dir := range prefixes {
+		dirName := d.cacheRoot + "/" + string(dir)
+		err := os.Mkdir(dirName, 0770)
+		if err != nil {
+			//Either cannot create directory, or directory already exists, let's try opening it to find out.
+			dirf, derr := os.Open(dirName)
+			if derr != nil {
+				return fmt.Errorf("Couldn't create or open %s: %s/%s", dirName, err, derr)
+			}
+
+			files, err := dirf.Readdirnames(0)
+			dirf.Close()
+			if err != nil {
+				return fmt.Errorf("Couldn't read %s: %s", dirName, err)
+			}
+
+			for _, filename := range files {
+				fullname := dirName + "/" + filename
+
+				// Leftovers from an interrupted Store.
+				if strings.Contains(filename, tempFileMarker) {
+					os.Remove(fullname)
+					continue
+				}
+				// Old style data files are dealt with alongside their metadata.
+				if strings.HasSuffix(filename, ".xml") {
+					continue
+				}
+
+				rh, err := d.loadEntry(fullname)
+				if err != nil {
+					var convErr error
+					rh, convErr = migrateLegacyEntry(fullname)
+					if convErr == nil {
+						migrated++
+						err = nil
+					} else {
+						d.log.Printf("Recovering from cache consistency error for %s: %s ", fullname, err)
+					}
+				}
+
+				if err != nil || time.Now().After(rh.Expires.Add(d.retain)) {
+					err := os.Remove(fullname)
+					if err != nil {
+						return fmt.Errorf("Failed to remove expired cache entry %s: %s", fullname, err)
+					}
+					continue
+				}
+
+				// Entries missing from the index were last used when they
+				// were written.
+				state, ok := index[filename]
+				if !ok {
+					if info, err := os.Stat(fullname); err == nil {
+						state.LastAccess = info.ModTime()
+					}
+				}
+
+				d.add(filename, CacheEntry{
+					HTTPCode:   rh.HTTPCode,
+					Expires:    rh.Expires,
+					Key:        rh.Key,
+					Size:       int64(rh.HeaderSize + rh.Length),
+					LastAccess: state.LastAccess,
+					Hits:       state.Hits,
+				})
+			}
+
+			// Any old style data files still around have either been migrated
+			// or have lost their metadata.
+			for _, filename := range files {
+				if strings.HasSuffix(filename, ".xml") {
+					os.Remove(dirName + "/" + filename)
+				}
+			}
+		}
+	}
+
+	if migrated > 0 {
+		d.log.Printf("Migrated %d cache entries to the packed cache format.", migrated)
+	}
+
+	if evicted := d.evict(""); evicted > 0 {
+		d.log.Printf("Evicted %d cache entries to fit the cache limits.", evicted)
+	}
+	return nil
+}
+
+// Reads the header of a packed cache record.
+func (d *DiskCache) loadEntry(filename string) (recordHeader, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return recordHeader{}, err
+	}
+	defer fp.Close()
+
+	return readRecordHeader(fp)
+}
+
+// Converts an entry stored as JSON metadata with a separate .xml data file
+// into a packed record in place.
+func migrateLegacyEntry(filename string) (recordHeader, error) {
+	var de CacheEntry
+
+	jsondata, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return recordHeader{}, err
+	}
+	err = json.Unmarshal(jsondata, &de)
+	if err != nil {
+		return recordHeader{}, err
+	}
+
+	data, err := ioutil.ReadFile(filename + ".xml")
+	if err != nil {
+		return recordHeader{}, err
+	}
+
+	record := packRecord(de.HTTPCode, de.Expires, encodingNone, "", data)
+	err = writeFileAtomic(filename, record)
+	if err != nil {
+		return recordHeader{}, err
+	}
+	os.Remove(filename + ".xml")
+
+	return recordHeader{HTTPCode: de.HTTPCode, Expires: de.Expires, Length: len(data), HeaderSize: recordHeaderSize}, nil
+}
+
+func (d *DiskCache) clean() error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.log.Printf("Clearing existing cache.")
+
+	os.Mkdir(d.cacheRoot, 0770)
+	os.Remove(d.cacheRoot + "/" + cacheIndexFile)
+
+	for _, dir := range prefixes {
+		dirName := d.cacheRoot + "/" + string(dir)
+		err := os.RemoveAll(dirName)
+		if err != nil {
+			return fmt.Errorf("Couldn't clear %s: %s", dirName, err)
+		}
+		err = os.Mkdir(dirName, 0770)
+		if err != nil {
+			return fmt.Errorf("Couldn't create %s: %s", dirName, err)
+		}
+	}
+	return nil
+}
+
+// Cache directories in use by disk caches in this process, two caches sharing
+// a directory would clear or evict each other's entries.
+var cacheDirs = struct {
+	dirs map[string]bool
+	sync.Mutex
+}{dirs: make(map[string]bool)}
+
+// Reserves a cache directory, failing if it is, contains or is inside one
+// already in use.
+func claimCacheDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	cacheDirs.Lock()
+	defer cacheDirs.Unlock()
+
+	for used := range cacheDirs.dirs {
+		if abs == used || strings.HasPrefix(abs, used+string(filepath.Separator)) ||
+			strings.HasPrefix(used, abs+string(filepath.Separator)) {
+			return "", fmt.Errorf("Cache directory %s overlaps %s, which is already in use", dir, used)
+		}
+	}
+	cacheDirs.dirs[abs] = true
+	return abs, nil
+}
+
+func releaseCacheDir(abs string) {
+	cacheDirs.Lock()
+	defer cacheDirs.Unlock()
+
+	delete(cacheDirs.dirs, abs)
+}
+
+func (d *DiskCache) expiredPurger() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-time.After(30 * time.Minute):
+		}
+
+		d.debugLog.Printf("Cleaning Up.")
+		now := time.Now()
+
+		d.Lock()
+		collectcount := 0
+		for tag, ce := range d.cacheFiles {
+			if now.After(ce.Expires.Add(d.retain)) {
+				os.Remove(d.filename(tag))
+				d.remove(tag)
+
+				collectcount++
+			}
+		}
+		d.Unlock()
+		d.debugLog.Printf("Collected %d expired entries.", collectcount)
+	}
+}
+
+// Loggers may be left nil to discard what would be logged.
+func orDiscard(l *log.Logger) *log.Logger {
+	if l == nil {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return l
+}
+
+// Returns a cache tag for a request, computed the same way for identical
+// requests regardless of parameter order. It has to match the tag apicache
+// stores the response under, which TestCacheTagMatchesApicache checks and
+// upstreamCache logs when it doesn't.
+func cacheTag(url string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if !proxyParams[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	hash := sha1.New()
+	io.WriteString(hash, url)
+	for _, k := range keys {
+		fmt.Fprintf(hash, "&%s=%s", k, params[k])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+func (d *DiskCache) filename(tag string) string {
+	return d.cacheRoot + "/" + string(tag[0]) + "/" + tag
+}
+
+// Adds or replaces an entry while keeping the size count straight. Must be
+// called with the lock held.
+func (d *DiskCache) add(cacheTag string, ce CacheEntry) {
+	d.remove(cacheTag)
+	d.cacheFiles[cacheTag] = ce
+	d.cacheBytes += ce.Size
+}
+
+// Removes an entry from the index, must be called with the lock held.
+func (d *DiskCache) remove(cacheTag string) {
+	if ce, exists := d.cacheFiles[cacheTag]; exists {
+		d.cacheBytes -= ce.Size
+		delete(d.cacheFiles, cacheTag)
+	}
+}
+
+func (d *DiskCache) Store(cacheTag string, HTTPCode int, data []byte, Expires time.Time) error {
+	return d.StoreKeyed(cacheTag, "", HTTPCode, data, Expires)
+}
+
+// Compressing and writing out the record happen without the lock, only the
+// rename and the index update need it so they stay in the same order.
+func (d *DiskCache) StoreKeyed(cacheTag string, key string, HTTPCode int, data []byte, Expires time.Time) error {
+	d.RLock()
+	closed := d.closed
+	d.RUnlock()
+	if closed {
+		return nil
+	}
+
+	encoding := encodingNone
+	if d.encoding != encodingNone && len(data) >= minCompressSize {
+		compressed, err := compressBody(d.encoding, data)
+		if err != nil {
+			d.log.Printf("Compression Error: %s", err)
+		} else if len(compressed) < len(data) {
+			encoding = d.encoding
+			data = compressed
+		}
+	}
+
+	record := packRecord(HTTPCode, Expires, encoding, key, data)
+	if d.limits.MaxBytes > 0 && int64(len(record)) > d.limits.MaxBytes {
+		d.debugLog.Printf("Not caching %s, %d bytes is larger than the whole cache.", cacheTag, len(record))
+		return nil
+	}
+
+	filename := d.filename(cacheTag)
+	temp, err := writeTempFile(filename, record)
+	if err != nil {
+		d.log.Printf("Unknown File Error: %s", err)
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		os.Remove(temp)
+		return nil
+	}
+	err = os.Rename(temp, filename)
+	if err != nil {
+		os.Remove(temp)
+		d.log.Printf("Unknown File Error: %s", err)
+		return err
+	}
+
+	// A refreshed entry keeps its hits, or LFU would evict the keys in
+	// heaviest use every time they're refreshed.
+	d.add(cacheTag, CacheEntry{
+		HTTPCode:   HTTPCode,
+		Expires:    Expires,
+		Key:        key,
+		Size:       int64(len(record)),
+		LastAccess: time.Now(),
+		Hits:       d.cacheFiles[cacheTag].Hits,
+	})
+	d.evict(cacheTag)
+	return nil
+}
+
+// Waits for any store in progress to finish or drop its entry, entries are
+// written atomically so nothing is left half written, and saves the eviction
+// state for the next start. The cache directory is free for another cache afterwards.
+func (d *DiskCache) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.done)
+
+	err := d.saveIndex()
+	if err != nil {
+		d.log.Printf("Couldn't save the cache index: %s", err)
+	}
+	releaseCacheDir(d.cacheRoot)
+	return err
+}
+
+// Drops an entry that turned out to be unreadable.
+func (d *DiskCache) invalidate(cacheTag string) {
+	d.Lock()
+	defer d.Unlock()
+
+	os.Remove(d.filename(cacheTag))
+	d.remove(cacheTag)
+}
+
+// Records a successful read for the eviction policy.
+func (d *DiskCache) touch(cacheTag string, Expires time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	ce, exists := d.cacheFiles[cacheTag]
+	if !exists || !ce.Expires.Equal(Expires) {
+		return
+	}
+	ce.LastAccess = time.Now()
+	ce.Hits++
+	d.cacheFiles[cacheTag] = ce
+}
+
+// Reads and verifies the stored record for an entry, returning the body as
+// stored.
+func (d *DiskCache) read(cacheTag string) (CacheEntry, recordHeader, []byte, error) {
+	d.RLock()
+
+	ce, exists := d.cacheFiles[cacheTag]
+	if !exists || time.Now().After(ce.Expires.Add(d.retain)) {
+		d.RUnlock()
+		return ce, recordHeader{}, nil, fmt.Errorf("Not cached.")
+	}
+
+	record, err := ioutil.ReadFile(d.filename(cacheTag))
+	d.RUnlock()
+	if err != nil {
+		d.invalidate(cacheTag)
+		return ce, recordHeader{}, nil, fmt.Errorf("Cache error - data file not found.")
+	}
+
+	rh, data, err := unpackRecord(record)
+	if err != nil || !rh.Expires.Equal(ce.Expires) {
+		d.log.Printf("Cache consistency error: %v (Got: %s Expected: %s)", err, rh.Expires, ce.Expires)
+		d.invalidate(cacheTag)
+		return ce, rh, nil, fmt.Errorf("Cache error - cache invalid.")
+	}
+
+	return ce, rh, data, nil
+}
+
+func (d *DiskCache) Get(cacheTag string) (int, []byte, time.Time, error) {
+	ce, rh, data, err := d.read(cacheTag)
+	if err != nil {
+		return 0, nil, ce.Expires, err
+	}
+
+	data, err = decompressBody(rh.Encoding, data)
+	if err != nil {
+		d.log.Printf("Cache consistency error: %s", err)
+		d.invalidate(cacheTag)
+		return 0, nil, ce.Expires, fmt.Errorf("Cache error - cache invalid.")
+	}
+
+	d.touch(cacheTag, ce.Expires)
+	return ce.HTTPCode, data, ce.Expires, nil
+}
+
+func (d *DiskCache) GetEncoded(cacheTag string, encoding string, Expires time.Time) ([]byte, error) {
+	ce, rh, data, err := d.read(cacheTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ce.Expires.Equal(Expires) || encodingNames[rh.Encoding] != encoding {
+		return nil, fmt.Errorf("Not cached in %s encoding.", encoding)
+	}
+
+	d.touch(cacheTag, ce.Expires)
+	return data, nil
+}
+
+func (d *DiskCache) Purge(cacheTag string) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, exists := d.cacheFiles[cacheTag]; !exists {
+		return 0, nil
+	}
+	os.Remove(d.filename(cacheTag))
+	d.remove(cacheTag)
+	return 1, nil
+}
+
+func (d *DiskCache) PurgeMatching(match func(key string) bool) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	count := 0
+	for tag, ce := range d.cacheFiles {
+		if match(ce.Key) {
+			os.Remove(d.filename(tag))
+			d.remove(tag)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (d *DiskCache) Size() (int, int64) {
+	d.RLock()
+	defer d.RUnlock()
+
+	return len(d.cacheFiles), d.cacheBytes
+}
+
+func (d *DiskCache) LogStats(w io.Writer) {
+	d.RLock()
+	defer d.RUnlock()
+
+	entries := 0
+	expired := 0
+
+	now := time.Now()
+	for _, ce := range d.cacheFiles {
+		entries++
+		if now.After(ce.Expires) {
+			expired++
+		}
+	}
+
+	fmt.Fprintf(w, "Cache Entries: %d  Expired Entries: %d\n", entries, expired)
+	fmt.Fprintf(w, "Cache Size: %dkb  Evictions: %d\n", d.cacheBytes/1024, atomic.LoadInt64(&d.evictions))
+	if d.limits.MaxBytes > 0 || d.limits.MaxEntries > 0 {
+		fmt.Fprintf(w, "Cache Limits: %dkb %d entries (%s)\n", d.limits.MaxBytes/1024, d.limits.MaxEntries, d.limits.Policy)
+	}
+}
+
+// NewDiskCache opens the cache in rootDir, clearing it first if clearCache is
+// set. Each cache needs a directory of its own, one overlapping a directory
+// already open in this process is refused. Close releases the directory.
+func NewDiskCache(rootDir string, clearCache bool, limits CacheLimits, encoding byte, retain time.Duration, logger, debugLog *log.Logger) (*DiskCache, error) {
+	var dc DiskCache
+
+	root, err := claimCacheDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	dc.cacheRoot = root
+	dc.cacheFiles = make(map[string]CacheEntry)
+	dc.done = make(chan struct{})
+	dc.limits = limits
+	dc.encoding = encoding
+	dc.retain = retain
+	dc.log = orDiscard(logger)
+	dc.debugLog = orDiscard(debugLog)
+
+	if clearCache {
+		err = dc.clean()
+	} else {
+		err = dc.init()
+	}
+	if err != nil {
+		releaseCacheDir(root)
+		return nil, err
+	}
+
+	go dc.expiredPurger()
+	return &dc, nil
+}
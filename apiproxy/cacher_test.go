@@ -0,0 +1,208 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+func newTestDiskCache(t *testing.T, limits CacheLimits) (*DiskCache, func()) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := NewDiskCache(dir, false, limits, encodingNone, 0, nil, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dc, func() {
+		dc.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDiskCacheKeepsHitsOnStore(t *testing.T) {
+	dc, cleanup := newTestDiskCache(t, CacheLimits{MaxEntries: 4, Policy: "lfu"})
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour)
+	dc.Store("0hot", 200, []byte("hot"), expires)
+	for i := 0; i < 5; i++ {
+		dc.Get("0hot")
+	}
+
+	// Refreshing the hot entry mustn't make it the first to go.
+	dc.Store("0hot", 200, []byte("hot"), expires.Add(time.Hour))
+	for i, tag := range []string{"1cold", "1warm", "2busy"} {
+		dc.Store(tag, 200, []byte(tag), expires)
+		for j := 0; j <= i; j++ {
+			dc.Get(tag)
+		}
+	}
+	dc.Store("3new", 200, []byte("new"), expires)
+
+	for tag, kept := range map[string]bool{"0hot": true, "1cold": false, "1warm": false, "2busy": true, "3new": true} {
+		_, _, _, err := dc.Get(tag)
+		if kept != (err == nil) {
+			t.Errorf("Entry %s kept %t, expected %t", tag, err == nil, kept)
+		}
+	}
+}
+
+// A new entry has no hits yet, the store that adds it mustn't evict it.
+func TestDiskCacheKeepsNewEntryOnEvict(t *testing.T) {
+	for _, policy := range []string{"lfu", "lru"} {
+		dc, cleanup := newTestDiskCache(t, CacheLimits{MaxEntries: 10, Policy: policy})
+
+		expires := time.Now().Add(time.Hour)
+		for i := 0; i < 10; i++ {
+			tag := fmt.Sprintf("%x", i)
+			dc.Store(tag, 200, []byte(tag), expires)
+			dc.Get(tag)
+		}
+		dc.Store("anew", 200, []byte("new"), expires)
+
+		if _, data, _, err := dc.Get("anew"); err != nil || string(data) != "new" {
+			t.Errorf("%s: new entry evicted by its own store: %q %v", policy, data, err)
+		}
+		cleanup()
+	}
+}
+
+func TestDiskCacheKeepsEvictionStateOnRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dc, err := NewDiskCache(dir, false, CacheLimits{}, encodingNone, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	dc.Store("0used", 200, []byte("used"), expires)
+	dc.Store("1idle", 200, []byte("idle"), expires)
+	for i := 0; i < 3; i++ {
+		dc.Get("0used")
+	}
+	used := dc.cacheFiles["0used"]
+	dc.Close()
+
+	dc, err = NewDiskCache(dir, false, CacheLimits{}, encodingNone, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+
+	restored := dc.cacheFiles["0used"]
+	if restored.Hits != 3 || !restored.LastAccess.Equal(used.LastAccess) {
+		t.Errorf("Restored %d hits last used %s, expected 3 hits last used %s", restored.Hits, restored.LastAccess, used.LastAccess)
+	}
+	if idle := dc.cacheFiles["1idle"]; idle.Hits != 0 || !idle.LastAccess.Before(restored.LastAccess) {
+		t.Errorf("Idle entry restored with %d hits last used %s", idle.Hits, idle.LastAccess)
+	}
+}
+
+// Stores of one entry racing each other must leave the index describing the
+// record that won.
+func TestDiskCacheConcurrentStores(t *testing.T) {
+	dc, cleanup := newTestDiskCache(t, CacheLimits{})
+	defer cleanup()
+
+	base := time.Now().Add(time.Hour).Truncate(time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			expires := base.Add(time.Duration(i) * time.Second)
+			dc.Store("0tag", 200, []byte(expires.String()), expires)
+			dc.Get("0tag")
+		}(i)
+	}
+	wg.Wait()
+
+	_, data, expires, err := dc.Get("0tag")
+	if err != nil || string(data) != expires.String() {
+		t.Errorf("Got %q expiring %s: %v", data, expires, err)
+	}
+}
+
+func TestMemoryCacheKeepsHitsOnStore(t *testing.T) {
+	mc := NewMemoryCache(10, 0, nil)
+	defer mc.Close()
+
+	expires := time.Now().Add(time.Hour)
+	mc.Store("hot", 200, []byte("hot"), expires)
+	for i := 0; i < 3; i++ {
+		mc.Get("hot")
+	}
+	mc.Store("hot", 200, []byte("hot"), expires.Add(time.Hour))
+
+	if hits := mc.entries["hot"].Value.(*memoryEntry).Hits; hits != 3 {
+		t.Errorf("Refreshed entry has %d hits, expected 3", hits)
+	}
+}
+
+// Remembers the tags apicache stores under.
+type tagRecorder struct {
+	tags []string
+}
+
+func (r *tagRecorder) Store(cacheTag string, HTTPCode int, data []byte, Expires time.Time) error {
+	r.tags = append(r.tags, cacheTag)
+	return nil
+}
+
+func (r *tagRecorder) Get(cacheTag string) (int, []byte, time.Time, error) {
+	return 0, nil, time.Time{}, fmt.Errorf("Not cached.")
+}
+
+// Coalescing, purging, stale serving and the gzip passthrough all find
+// entries by computing the tag apicache stores them under, so cacheTag has to
+// agree with apicache.
+func TestCacheTagMatchesApicache(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now().UTC()
+		fmt.Fprintf(w, `<?xml version='1.0' encoding='UTF-8'?>
+<eveapi version="2"><currentTime>%s</currentTime><result/><cachedUntil>%s</cachedUntil></eveapi>`,
+			now.Format("2006-01-02 15:04:05"), now.Add(time.Hour).Format("2006-01-02 15:04:05"))
+	}))
+	defer api.Close()
+
+	recorder := &tagRecorder{}
+	client := apicache.NewClient(recorder)
+	client.BaseURL = api.URL
+	client.Retries = 0
+
+	url := "/char/SkillQueue.xml.aspx"
+	params := map[string]string{"keyID": "123", "vCode": "abc", "characterID": "456"}
+
+	req := client.NewRequest(url)
+	for k, v := range params {
+		req.Set(k, v)
+	}
+	_, err := req.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.tags) != 1 {
+		t.Fatalf("apicache stored %d entries, expected 1", len(recorder.tags))
+	}
+	// Proxy parameters never reach apicache and must not change the tag.
+	params["client"] = "someone"
+	if tag := cacheTag(url, params); recorder.tags[0] != tag {
+		t.Errorf("apicache stored under %s, cacheTag gives %s", recorder.tags[0], tag)
+	}
+}
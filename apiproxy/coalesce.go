@@ -0,0 +1,59 @@
+package apiproxy
+
+import (
+	"sync/atomic"
+
+	"github.com/inominate/apicache"
+)
+
+// An upstream request that others can wait on.
+type flight struct {
+	done chan struct{}
+
+	resp *apicache.Response
+	info fetchInfo
+	err  error
+}
+
+// Runs fetch unless a request with the same key is already in flight, in
+// which case it waits for and shares that result instead. A fetch refused
+// with errOverQuota only answers its own request, the others waiting on it
+// try again.
+func (s *Server) coalesce(key string, fetch func() (*apicache.Response, fetchInfo, error)) (*apicache.Response, fetchInfo, error) {
+	s.flightsLock.Lock()
+	for {
+		f, ok := s.flights[key]
+		if !ok {
+			break
+		}
+		s.flightsLock.Unlock()
+
+		<-f.done
+		if f.err == errOverQuota {
+			s.flightsLock.Lock()
+			continue
+		}
+
+		atomic.AddInt64(&s.coalescedCount, 1)
+		if f.resp == nil {
+			return nil, f.info, f.err
+		}
+		// Everyone gets their own copy of the response.
+		resp := *f.resp
+		return &resp, f.info, f.err
+	}
+
+	f := &flight{done: make(chan struct{})}
+	s.flights[key] = f
+	s.flightsLock.Unlock()
+
+	defer func() {
+		s.flightsLock.Lock()
+		delete(s.flights, key)
+		s.flightsLock.Unlock()
+		close(f.done)
+	}()
+
+	f.resp, f.info, f.err = fetch()
+	return f.resp, f.info, f.err
+}
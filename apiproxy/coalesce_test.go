@@ -0,0 +1,85 @@
+package apiproxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+// Starts a fetch that holds the flight for key until release is closed.
+func leadFlight(s *Server, key string, resp *apicache.Response, err error, release chan struct{}) chan error {
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		_, _, ferr := s.coalesce(key, func() (*apicache.Response, fetchInfo, error) {
+			close(started)
+			<-release
+			return resp, fetchInfo{workerID: "1"}, err
+		})
+		result <- ferr
+	}()
+	<-started
+	return result
+}
+
+// Waits until n requests besides the leader are waiting on key.
+func followFlight(s *Server, key string, n int) ([]*apicache.Response, []fetchInfo, *sync.WaitGroup) {
+	resps := make([]*apicache.Response, n)
+	infos := make([]fetchInfo, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i], infos[i], _ = s.coalesce(key, func() (*apicache.Response, fetchInfo, error) {
+				return &apicache.Response{HTTPCode: 200}, fetchInfo{workerID: "own"}, nil
+			})
+		}(i)
+	}
+	// Give them time to find the flight.
+	time.Sleep(50 * time.Millisecond)
+	return resps, infos, wg
+}
+
+func TestCoalesceSharesResult(t *testing.T) {
+	s := &Server{flights: make(map[string]*flight)}
+
+	release := make(chan struct{})
+	leader := leadFlight(s, "tag", &apicache.Response{HTTPCode: 200}, nil, release)
+	_, infos, wg := followFlight(s, "tag", 3)
+	close(release)
+	wg.Wait()
+	<-leader
+
+	for i, info := range infos {
+		if info.workerID != "1" {
+			t.Errorf("Follower %d got worker %s, expected the leader's result", i, info.workerID)
+		}
+	}
+	if s.coalescedCount != 3 {
+		t.Errorf("Coalesced %d requests, expected 3", s.coalescedCount)
+	}
+}
+
+// A client over its quota mustn't pass its refusal on to everyone else asking
+// for the same thing.
+func TestCoalesceDoesNotShareQuotaRefusal(t *testing.T) {
+	s := &Server{flights: make(map[string]*flight)}
+
+	release := make(chan struct{})
+	leader := leadFlight(s, "tag", quotaError("request"), errOverQuota, release)
+	resps, infos, wg := followFlight(s, "tag", 3)
+	close(release)
+	wg.Wait()
+
+	if err := <-leader; err != errOverQuota {
+		t.Errorf("Leader got %v, expected errOverQuota", err)
+	}
+	for i := range resps {
+		if resps[i].HTTPCode != 200 || infos[i].workerID == "Q" {
+			t.Errorf("Follower %d got HTTP %d from worker %s", i, resps[i].HTTPCode, infos[i].workerID)
+		}
+	}
+}
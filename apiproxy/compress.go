@@ -0,0 +1,88 @@
+package apiproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression applied to cached bodies, stored in the record header.
+const (
+	encodingNone byte = iota
+	encodingGzip
+	encodingZstd
+)
+
+var encodingNames = map[byte]string{
+	encodingNone: "none",
+	encodingGzip: "gzip",
+	encodingZstd: "zstd",
+}
+
+// Bodies smaller than this aren't worth compressing.
+const minCompressSize = 512
+
+func parseEncoding(name string) (byte, error) {
+	if name == "" {
+		return encodingNone, nil
+	}
+	for e, n := range encodingNames {
+		if strings.ToLower(name) == n {
+			return e, nil
+		}
+	}
+	return encodingNone, fmt.Errorf("Unknown cache compression %s", name)
+}
+
+// The zstd encoder and decoder are safe for concurrent use with
+// EncodeAll/DecodeAll and expensive to create, so share them.
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+func compressBody(encoding byte, data []byte) ([]byte, error) {
+	switch encoding {
+	case encodingNone:
+		return data, nil
+	case encodingGzip:
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		_, err := gz.Write(data)
+		if err == nil {
+			err = gz.Close()
+		}
+		return buf.Bytes(), err
+	case encodingZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("Unknown encoding %d", encoding)
+}
+
+func decompressBody(encoding byte, data []byte) ([]byte, error) {
+	switch encoding {
+	case encodingNone:
+		return data, nil
+	case encodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	case encodingZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("Unknown encoding %d", encoding)
+}
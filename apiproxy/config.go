@@ -0,0 +1,454 @@
+package apiproxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Config holds every setting of a Server. It is read from the config file,
+// see LoadConfig, or can be built from DefaultConfig.
+type Config struct {
+	Listen    string
+	Listeners []ListenerConfig `xml:"Listener,omitempty"`
+
+	// Named API servers besides the default, and the header used to pick one.
+	Upstreams      []UpstreamConfig `xml:"Upstream,omitempty"`
+	UpstreamHeader string           `xml:",omitempty"`
+
+	Threads int
+	Workers int
+
+	Retries    int
+	APITimeout int
+
+	// Seconds allowed for requests and queued jobs to finish on shutdown.
+	ShutdownTimeout int `xml:",omitempty"`
+
+	RequestsPerSecond int
+	ErrorPeriod       int
+	MaxErrors         int
+
+	CacheBackend string
+	CacheDir     string
+	FastStart    bool
+
+	MaxCacheBytes   int64  `xml:",omitempty"`
+	MaxCacheEntries int    `xml:",omitempty"`
+	EvictionPolicy  string `xml:",omitempty"`
+
+	CacheCompression string `xml:",omitempty"`
+
+	StaleWhileRevalidate int `xml:",omitempty"`
+	StaleIfError         int `xml:",omitempty"`
+
+	MemoryCacheEntries int    `xml:",omitempty"`
+	RedisAddr          string `xml:",omitempty"`
+	RedisPassword      string `xml:",omitempty"`
+	RedisDB            int    `xml:",omitempty"`
+	RedisPrefix        string `xml:",omitempty"`
+
+	Secret               string `xml:",omitempty"`
+	ProxyAddr            string `xml:",omitempty"`
+	RealRemoteAddrHeader string `xml:",omitempty"`
+	UserAgent            string `xml:",omitempty"`
+
+	// Seconds between checks of the config file for changes, 0 to only
+	// reload on SIGHUP.
+	WatchConfig int `xml:",omitempty"`
+
+	Logging  LogConfig
+	Replay   ReplayConfig
+	Faults   FaultConfig
+	Prewarm  PrewarmConfig
+	Priority PriorityConfig
+	Quota    QuotaConfig
+	Auth     AuthConfig
+}
+
+type LogConfig struct {
+	LogFile string
+	// Access log format, text or json.
+	Format string
+	// Where the access log goes instead of the general log, and which json
+	// fields it has in order, all of them when none are given.
+	AccessLogFile string   `xml:",omitempty"`
+	Fields        []string `xml:"Field,omitempty"`
+
+	// Built in rotation, MaxSize in megabytes and MaxAge in hours. Zero
+	// disables each.
+	MaxSize    int
+	MaxAge     int
+	MaxBackups int
+	Compress   bool
+
+	LogRequests bool
+	CensorLog   bool
+
+	Debug        bool
+	DebugLogFile string
+}
+
+// Record API exchanges to an archive, or answer from one instead of the API.
+type ReplayConfig struct {
+	Record string `xml:",omitempty"`
+	Replay string `xml:",omitempty"`
+
+	// Take as long as the recorded requests did when replaying.
+	Timing bool `xml:",omitempty"`
+}
+
+// Faults injected into responses for testing clients. Nothing is injected
+// unless rules are configured or the header is set.
+type FaultConfig struct {
+	Header string      `xml:",omitempty"`
+	Rules  []FaultRule `xml:"Rule"`
+}
+
+// Injects a fault into a fraction of the requests for an endpoint, or every
+// endpoint under it when it ends in /. Type is latency, with Latency in
+// milliseconds, error with an API error Code, truncate or reset.
+type FaultRule struct {
+	Endpoint string  `xml:"endpoint,attr,omitempty"`
+	Type     string  `xml:"type,attr"`
+	Rate     float64 `xml:"rate,attr"`
+	Latency  int     `xml:"latency,attr,omitempty"`
+	Code     int     `xml:"code,attr,omitempty"`
+}
+
+type PrewarmConfig struct {
+	HotRequests  int
+	HotPeriod    int
+	RefreshDelay int
+	MaxHotKeys   int
+
+	Keys []string `xml:"Key"`
+}
+
+type PriorityConfig struct {
+	// Request header naming the priority class to use.
+	Header  string
+	Default string
+
+	Classes []PriorityClass  `xml:"Class"`
+	Clients []PriorityClient `xml:"Client"`
+}
+
+type PriorityClass struct {
+	Name   string `xml:"name,attr"`
+	Weight int    `xml:"weight,attr"`
+}
+
+// Assigns a priority class to everything from a client address.
+type PriorityClient struct {
+	Addr  string `xml:"addr,attr"`
+	Class string `xml:"class,attr"`
+}
+
+type QuotaConfig struct {
+	// Header identifying clients, otherwise they're known by address.
+	IdentityHeader string
+
+	// Default allowances for each client, 0 for none.
+	RequestsPerSecond int
+	MaxErrors         int
+
+	// Seconds to wait for room in a client's allowance.
+	Timeout int
+
+	Clients []ClientQuota `xml:"Client"`
+}
+
+// Where to accept connections. Type is tcp, unix or tls. Unix sockets may be
+// given a file Mode in octal, TLS needs a Cert and Key and will require
+// client certificates signed by ClientCA if one is given.
+type ListenerConfig struct {
+	Type     string `xml:"type,attr,omitempty"`
+	Addr     string `xml:"addr,attr"`
+	Mode     string `xml:"mode,attr,omitempty"`
+	Cert     string `xml:"cert,attr,omitempty"`
+	Key      string `xml:"key,attr,omitempty"`
+	ClientCA string `xml:"clientca,attr,omitempty"`
+}
+
+// A named API server. Requests reach it through PathPrefix or by naming it in
+// the upstream header. Timeout, UserAgent and the limits default to the
+// global settings, but the limiters are always its own.
+type UpstreamConfig struct {
+	Name       string `xml:"name,attr"`
+	BaseURL    string
+	PathPrefix string `xml:",omitempty"`
+
+	Timeout   int    `xml:",omitempty"`
+	UserAgent string `xml:",omitempty"`
+
+	RequestsPerSecond int `xml:",omitempty"`
+	MaxErrors         int `xml:",omitempty"`
+
+	// TLS settings for an https BaseURL. CACert replaces the system's
+	// certificate pool, ClientCert and ClientKey give a client certificate.
+	CACert             string `xml:",omitempty"`
+	ClientCert         string `xml:",omitempty"`
+	ClientKey          string `xml:",omitempty"`
+	ServerName         string `xml:",omitempty"`
+	InsecureSkipVerify bool   `xml:",omitempty"`
+}
+
+type ClientQuota struct {
+	ID                string `xml:"id,attr"`
+	RequestsPerSecond int    `xml:"rps,attr"`
+	MaxErrors         int    `xml:"errors,attr"`
+}
+
+type AuthConfig struct {
+	Required bool
+
+	// Where clients may give their token, either one may be blank.
+	Header string
+	Param  string
+
+	Tokens []AccessToken `xml:"Token"`
+}
+
+type AccessToken struct {
+	Name     string `xml:"name,attr"`
+	Token    string `xml:"token,attr"`
+	Disabled bool   `xml:"disabled,attr,omitempty"`
+
+	// Page prefixes the token may use, such as /char/, all pages if none.
+	Allow []string `xml:"Allow"`
+}
+
+// Redacted returns a copy of the config with the control secret, redis
+// password and access tokens blanked, safe to show.
+func (c Config) Redacted() Config {
+	r := c
+	r.Secret = ""
+	r.RedisPassword = ""
+
+	r.Auth.Tokens = make([]AccessToken, len(c.Auth.Tokens))
+	for i, t := range c.Auth.Tokens {
+		t.Token = ""
+		r.Auth.Tokens[i] = t
+	}
+	return r
+}
+
+// NewSecret returns a random secret suitable for the control API.
+func NewSecret() string {
+	buf := make([]byte, 32)
+	io.ReadFull(rand.Reader, buf)
+	return fmt.Sprintf("%x", buf)
+}
+
+var defaultConfig = Config{
+	Listen:  "127.0.0.1:3748",
+	Threads: 0,
+	Workers: 10,
+
+	FastStart: true,
+
+	// As per CCP FoxFour.
+	RequestsPerSecond: 30,
+
+	// According to CCP FocFour error limit seems to be
+	// 300 errors over 3 minutes.
+	ErrorPeriod: 180,
+	MaxErrors:   250,
+
+	Retries:    3,
+	APITimeout: 60,
+
+	UpstreamHeader: "X-Proxy-Upstream",
+
+	ShutdownTimeout: 30,
+
+	CacheBackend: "disk",
+	CacheDir:     "cache/",
+
+	EvictionPolicy: "lru",
+
+	MemoryCacheEntries: 10000,
+	RedisAddr:          "127.0.0.1:6379",
+	RedisPrefix:        "apiproxy:",
+
+	Logging: LogConfig{
+		Format:    "text",
+		CensorLog: true,
+	},
+	Prewarm: PrewarmConfig{
+		HotPeriod:    3600,
+		RefreshDelay: 5,
+		MaxHotKeys:   1000,
+	},
+	Quota: QuotaConfig{
+		Timeout: 5,
+	},
+	Auth: AuthConfig{
+		Header: "X-Proxy-Token",
+		Param:  "proxytoken",
+	},
+	Priority: PriorityConfig{
+		Header:  "X-Proxy-Priority",
+		Default: "normal",
+		Classes: []PriorityClass{
+			{"interactive", 8},
+			{"normal", 4},
+			{"bulk", 1},
+		},
+	},
+}
+
+// DefaultConfig returns the settings used for anything a config file leaves
+// out.
+func DefaultConfig() Config {
+	return defaultConfig
+}
+
+// LoadConfig reads a config file in the format its extension implies, applies
+// any environment overrides and checks the result.
+func LoadConfig(filename string) (Config, error) {
+	conf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return defaultConfig, err
+	}
+
+	newConfig := defaultConfig
+	// XML appends to lists, configured classes replace the defaults.
+	newConfig.Priority.Classes = nil
+	err = decodeConfig(ConfigFormat(filename), conf, &newConfig)
+	if err != nil {
+		return defaultConfig, err
+	}
+	if len(newConfig.Priority.Classes) == 0 {
+		newConfig.Priority.Classes = defaultConfig.Priority.Classes
+	}
+
+	err = applyEnv(&newConfig)
+	if err != nil {
+		return defaultConfig, err
+	}
+
+	err = validateConfig(newConfig)
+	if err != nil {
+		return defaultConfig, err
+	}
+	return newConfig, nil
+}
+
+func validateConfig(c Config) error {
+	err := validEvictionPolicy(c.EvictionPolicy)
+	if err != nil {
+		return fmt.Errorf("EvictionPolicy: %s", err)
+	}
+	_, err = parseEncoding(c.CacheCompression)
+	if err != nil {
+		return fmt.Errorf("CacheCompression: %s", err)
+	}
+
+	err = validateLogging(c.Logging)
+	if err != nil {
+		return err
+	}
+
+	err = validateListeners(c)
+	if err != nil {
+		return err
+	}
+	if c.Replay.Record != "" && c.Replay.Replay != "" {
+		return fmt.Errorf("Replay.Record and Replay.Replay can't both be set")
+	}
+	err = validateFaults(c.Faults)
+	if err != nil {
+		return err
+	}
+	err = validateUpstreams(c)
+	if err != nil {
+		return err
+	}
+
+	err = validatePriorities(c.Priority)
+	if err != nil {
+		return err
+	}
+	err = validateQuotas(c)
+	if err != nil {
+		return err
+	}
+	err = validateAuth(c.Auth)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(c.CacheBackend) {
+	case "", "disk":
+		if c.CacheDir == "" {
+			return fmt.Errorf("CacheDir is needed for the disk cache")
+		}
+	case "memory":
+		if c.MemoryCacheEntries <= 0 {
+			return fmt.Errorf("MemoryCacheEntries must be positive")
+		}
+	case "redis":
+		if c.RedisAddr == "" {
+			return fmt.Errorf("RedisAddr is needed for the redis cache")
+		}
+	default:
+		return fmt.Errorf("Unknown CacheBackend %s", c.CacheBackend)
+	}
+	return nil
+}
+
+func validatePriorities(p PriorityConfig) error {
+	names := make(map[string]bool)
+	for _, c := range p.Classes {
+		name := strings.ToLower(c.Name)
+		if name == "" || name == backgroundClass || names[name] {
+			return fmt.Errorf("Invalid or duplicate Priority.Class name %q", c.Name)
+		}
+		if c.Weight <= 0 {
+			return fmt.Errorf("Priority.Class %s needs a positive Weight", c.Name)
+		}
+		names[name] = true
+	}
+
+	if !names[strings.ToLower(p.Default)] {
+		return fmt.Errorf("Priority.Default class %s is not defined", p.Default)
+	}
+	for _, c := range p.Clients {
+		if !names[strings.ToLower(c.Class)] {
+			return fmt.Errorf("Priority.Client %s class %s is not defined", c.Addr, c.Class)
+		}
+	}
+	return nil
+}
+
+// Client allowances are carved out of the global limits, so none may exceed
+// them and explicitly configured clients can't add up to more than them.
+func validateQuotas(c Config) error {
+	q := c.Quota
+	if q.RequestsPerSecond > c.RequestsPerSecond {
+		return fmt.Errorf("Quota.RequestsPerSecond %d exceeds RequestsPerSecond %d", q.RequestsPerSecond, c.RequestsPerSecond)
+	}
+	if q.MaxErrors > c.MaxErrors {
+		return fmt.Errorf("Quota.MaxErrors %d exceeds MaxErrors %d", q.MaxErrors, c.MaxErrors)
+	}
+
+	rps, errors := 0, 0
+	for _, client := range q.Clients {
+		if client.ID == "" {
+			return fmt.Errorf("Quota.Client needs an ID")
+		}
+		rps += client.RequestsPerSecond
+		errors += client.MaxErrors
+	}
+	if rps > c.RequestsPerSecond {
+		return fmt.Errorf("Quota.Client rps total %d exceeds RequestsPerSecond %d", rps, c.RequestsPerSecond)
+	}
+	if errors > c.MaxErrors {
+		return fmt.Errorf("Quota.Client errors total %d exceeds MaxErrors %d", errors, c.MaxErrors)
+	}
+	return nil
+}
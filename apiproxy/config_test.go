@@ -0,0 +1,66 @@
+package apiproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigErrorsNameField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		file, config, field string
+	}{
+		{"bad.xml", "<configFile>\n  <Workers>abc</Workers>\n</configFile>", "Workers on line 2"},
+		{"bad.xml", "<configFile><Upstream name=\"a\"><Timeout>x</Timeout></Upstream></configFile>", "Upstream.Timeout"},
+		{"bad.xml", "<configFile><Logging><Compress>maybe</Compress></Logging></configFile>", "Logging.Compress"},
+		{"bad.json", `{"Quota": {"RequestsPerSecond": "x"}}`, "Quota.RequestsPerSecond"},
+		{"bad.yaml", "Logging:\n  MaxSize: x\n", "Logging.MaxSize"},
+		{"bad.toml", "[Quota]\nRequestsPerSecond = \"x\"\n", "Quota.RequestsPerSecond on line 2"},
+		{"bad.toml", "[[Upstreams]]\nName = 1\n", "Upstreams.Name"},
+		{"bad.toml", "Unknown = 1\n", "Unknown"},
+		{"bad.xml", "<configFile><CacheDir></CacheDir></configFile>", "CacheDir"},
+		{"bad.json", `{"CacheBackend": "redis", "RedisAddr": ""}`, "RedisAddr"},
+		{"bad.json", `{"CacheBackend": "memory", "MemoryCacheEntries": 0}`, "MemoryCacheEntries"},
+		{"bad.json", `{"CacheBackend": "tape"}`, "CacheBackend"},
+		{"bad.json", `{"EvictionPolicy": "random"}`, "EvictionPolicy"},
+		{"bad.json", `{"CacheCompression": "rar"}`, "CacheCompression"},
+		{"bad.json", `{"Logging": {"Format": "csv"}}`, "Logging.Format"},
+		{"bad.json", `{"Priority": {"Default": "nope"}}`, "Priority.Default"},
+	} {
+		filename := filepath.Join(dir, tc.file)
+		err := ioutil.WriteFile(filename, []byte(tc.config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = LoadConfig(filename)
+		if err == nil {
+			t.Errorf("%s config %q accepted", tc.file, tc.config)
+		} else if !strings.Contains(err.Error(), tc.field) {
+			t.Errorf("%s config %q: error %q doesn't name %s", tc.file, tc.config, err, tc.field)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Secret = "secret"
+	conf.RedisPassword = "password"
+	conf.Auth.Tokens = []AccessToken{{Name: "app", Token: "token"}}
+
+	r := conf.Redacted()
+	if r.Secret != "" || r.RedisPassword != "" || r.Auth.Tokens[0].Token != "" || r.Auth.Tokens[0].Name != "app" {
+		t.Errorf("Redacted config still has secrets: %+v", r)
+	}
+	if conf.Auth.Tokens[0].Token != "token" {
+		t.Errorf("Redacting changed the original tokens")
+	}
+}
@@ -0,0 +1,188 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFormat returns the format of a config file, XML unless its extension
+// says otherwise. Every format uses the same field names, lists are named
+// after the field holding them in all but XML.
+func ConfigFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "xml"
+}
+
+func decodeConfig(format string, data []byte, c *Config) error {
+	switch format {
+	case "json":
+		return decodeJSONConfig(data, c)
+	case "yaml":
+		var raw interface{}
+		err := yaml.Unmarshal(data, &raw)
+		if err != nil {
+			return err
+		}
+		// Going through JSON keeps field names the same as the other formats.
+		data, err = json.Marshal(jsonCompatible(raw))
+		if err != nil {
+			return err
+		}
+		return decodeJSONConfig(data, c)
+	case "toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return tomlError(err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("Unknown field %s", undecoded[0])
+		}
+		return nil
+	}
+	return decodeXMLConfig(data, c)
+}
+
+// The toml package names the key it was on in its errors, but only in the
+// message for some of them.
+var tomlKeyError = regexp.MustCompile(`^toml: line (\d+) \(last key "([^"]*)"\): (.*)$`)
+
+func tomlError(err error) error {
+	if m := tomlKeyError.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("Error in %s on line %s: %s", m[2], m[1], m[3])
+	}
+	return err
+}
+
+func decodeXMLConfig(data []byte, c *Config) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	err := d.Decode(c)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*xml.SyntaxError); ok {
+		return err
+	}
+
+	// Value errors don't say where they are, but the decoder stops just past
+	// the element holding the value.
+	offset := d.InputOffset()
+	path := xmlPathAt(data, offset)
+	if path == "" {
+		return err
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	if e, ok := err.(*strconv.NumError); ok {
+		return fmt.Errorf("Invalid value %q for %s on line %d", e.Num, path, line)
+	}
+	return fmt.Errorf("Invalid value for %s on line %d: %s", path, line, err)
+}
+
+// Finds the element that ends last by offset in an XML document, as a path
+// below the root element.
+func xmlPathAt(data []byte, offset int64) string {
+	d := xml.NewDecoder(bytes.NewReader(data))
+
+	var stack []string
+	var path string
+	for d.InputOffset() < offset {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, tok.Name.Local)
+			path = strings.Join(stack[1:], ".")
+		case xml.EndElement:
+			path = strings.Join(stack[1:], ".")
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return path
+}
+
+func decodeJSONConfig(data []byte, c *Config) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	err := d.Decode(c)
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Errorf("Invalid value for %s: expected %s, got %s", e.Field, e.Type, e.Value)
+	}
+	return err
+}
+
+// YAML decodes maps with interface keys, which JSON can't encode.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonCompatible(v[i])
+		}
+	}
+	return v
+}
+
+// EncodeConfig writes out a config in the given format, as returned by
+// ConfigFormat.
+func EncodeConfig(format string, c Config) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(c, "", "  ")
+	case "yaml":
+		return yaml.Marshal(yamlValue(reflect.ValueOf(c)))
+	case "toml":
+		buf := &bytes.Buffer{}
+		err := toml.NewEncoder(buf).Encode(c)
+		return buf.Bytes(), err
+	}
+	// Config files have always had this root element.
+	buf := &bytes.Buffer{}
+	e := xml.NewEncoder(buf)
+	e.Indent("", "  ")
+	err := e.EncodeElement(c, xml.StartElement{Name: xml.Name{Local: "configFile"}})
+	return buf.Bytes(), err
+}
+
+// Builds YAML keyed by field name in field order, yaml.v2 would otherwise
+// lower case every key.
+func yamlValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		var m yaml.MapSlice
+		for i := 0; i < v.NumField(); i++ {
+			m = append(m, yaml.MapItem{Key: v.Type().Field(i).Name, Value: yamlValue(v.Field(i))})
+		}
+		return m
+	case reflect.Slice:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = yamlValue(v.Index(i))
+		}
+		return list
+	}
+	return v.Interface()
+}
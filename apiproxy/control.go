@@ -0,0 +1,212 @@
+package apiproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Header or form value used to give the control secret.
+const controlSecretHeader = "X-Proxy-Secret"
+const controlSecretParam = "secret"
+
+type controlCommand func(s *Server, w http.ResponseWriter, req *http.Request)
+
+var controlCommands = map[string]controlCommand{
+	"/control/purge":   (*Server).controlPurge,
+	"/control/refresh": (*Server).controlRefresh,
+	"/control/pause":   (*Server).controlPause,
+	"/control/resume":  (*Server).controlResume,
+	"/control/limits":  (*Server).controlLimits,
+	"/control/config":  (*Server).controlConfig,
+}
+
+// Commands that change something, which have to be sent as a POST so a stray
+// GET from a browser or crawler can't set them off.
+var controlMutating = map[string]bool{
+	"/control/purge":   true,
+	"/control/refresh": true,
+	"/control/pause":   true,
+	"/control/resume":  true,
+	"/control/limits":  true,
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		s.log.Printf("Unknown JSON Marshal Error: %s", err)
+		return
+	}
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+func (s *Server) writeJSONError(w http.ResponseWriter, code int, format string, a ...interface{}) {
+	s.writeJSON(w, code, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+// Whether the request carries the control secret, never true when none is
+// configured.
+func hasSecret(conf *Config, req *http.Request) bool {
+	given := req.Header.Get(controlSecretHeader)
+	if given == "" {
+		given = req.Form.Get(controlSecretParam)
+	}
+	return conf.Secret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(conf.Secret)) == 1
+}
+
+// Entry point for everything under /control/, which is only available when
+// a Secret has been configured.
+func (s *Server) controlHandler(w http.ResponseWriter, req *http.Request) {
+	url := path.Clean(req.URL.Path)
+	conf := s.getConf()
+
+	if conf.Secret == "" {
+		s.writeJSONError(w, 404, "Control API disabled, no Secret configured.")
+		return
+	}
+
+	if !hasSecret(conf, req) {
+		s.log.Printf("%s - Unauthorized control request for %s", clientAddr(conf, req), url)
+		s.writeJSONError(w, 403, "Invalid secret.")
+		return
+	}
+
+	command, ok := controlCommands[strings.ToLower(url)]
+	if !ok {
+		s.writeJSONError(w, 404, "Unknown control command %s.", url)
+		return
+	}
+	if controlMutating[strings.ToLower(url)] && req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.writeJSONError(w, 405, "%s must be sent as a POST.", url)
+		return
+	}
+
+	s.log.Printf("%s - Control request %s", clientAddr(conf, req), url)
+	command(s, w, req)
+}
+
+// Purges a single cache entry by tag, every entry matching a page and
+// parameters, or with all=1 the whole cache. The page may end in / to match
+// every page under it, and may be left out to match the parameters on any
+// page.
+func (s *Server) controlPurge(w http.ResponseWriter, req *http.Request) {
+	pc, ok := s.cache.(PurgeableCache)
+	if !ok {
+		s.writeJSONError(w, 501, "Cache backend does not support purging.")
+		return
+	}
+
+	params := makeParams(req)
+	for _, k := range []string{"tag", "all", "page", controlSecretParam} {
+		delete(params, k)
+	}
+	page := req.Form.Get("page")
+
+	var count int
+	var err error
+	switch {
+	case req.Form.Get("tag") != "":
+		count, err = pc.Purge(req.Form.Get("tag"))
+	case req.Form.Get("all") == "1":
+		count, err = pc.PurgeMatching(func(string) bool { return true })
+	case page != "" || len(params) > 0:
+		count, err = pc.PurgeMatching(keyMatcher(page, params))
+	default:
+		s.writeJSONError(w, 400, "Need tag, page or parameters to match, or all=1.")
+		return
+	}
+
+	if err != nil {
+		s.writeJSONError(w, 500, "Purge failed after %d entries: %s", count, err)
+		return
+	}
+	s.writeJSON(w, 200, map[string]int{"purged": count})
+}
+
+// Fetches a page from the API bypassing the cache. The page is given as the
+// page form value along with the usual parameters for it.
+func (s *Server) controlRefresh(w http.ResponseWriter, req *http.Request) {
+	page := path.Clean(req.Form.Get("page"))
+	handler, valid := validPages[strings.ToLower(page)]
+	if !valid {
+		s.writeJSONError(w, 400, "Invalid API page %s.", page)
+		return
+	}
+	if handler == nil {
+		handler = (*Server).defaultHandler
+	}
+
+	params := makeParams(req)
+	delete(params, "page")
+	delete(params, controlSecretParam)
+	params["force"] = "1"
+	params["client"] = "control"
+
+	resp, _ := handler(s, page, params)
+	s.writeJSON(w, 200, map[string]interface{}{
+		"HTTPCode":  resp.HTTPCode,
+		"Expires":   resp.Expires,
+		"ErrorCode": resp.Error.ErrorCode,
+		"ErrorText": resp.Error.ErrorText,
+	})
+}
+
+// Stops the workers from picking up new jobs, requests queue up until
+// resumed.
+func (s *Server) controlPause(w http.ResponseWriter, req *http.Request) {
+	s.workQueue.SetPaused(true)
+	s.writeJSON(w, 200, map[string]bool{"paused": true})
+}
+
+func (s *Server) controlResume(w http.ResponseWriter, req *http.Request) {
+	s.workQueue.SetPaused(false)
+	s.writeJSON(w, 200, map[string]bool{"paused": false})
+}
+
+// Changes RequestsPerSecond and MaxErrors, given as rps and errors. Either
+// may be left out to keep its current value.
+func (s *Server) controlLimits(w http.ResponseWriter, req *http.Request) {
+	var rps, maxErrors int
+	var err error
+	if v := req.Form.Get("rps"); v != "" {
+		rps, err = strconv.Atoi(v)
+		if err != nil || rps <= 0 {
+			s.writeJSONError(w, 400, "Invalid rps %s.", v)
+			return
+		}
+	}
+	if v := req.Form.Get("errors"); v != "" {
+		maxErrors, err = strconv.Atoi(v)
+		if err != nil || maxErrors <= 0 {
+			s.writeJSONError(w, 400, "Invalid errors %s.", v)
+			return
+		}
+	}
+
+	conf := s.setLimits(rps, maxErrors)
+	s.log.Printf("Limits changed to %d requests per second and %d errors per %d seconds.",
+		conf.RequestsPerSecond, conf.MaxErrors, conf.ErrorPeriod)
+
+	s.writeJSON(w, 200, map[string]int{
+		"RequestsPerSecond": conf.RequestsPerSecond,
+		"MaxErrors":         conf.MaxErrors,
+		"ErrorPeriod":       conf.ErrorPeriod,
+	})
+}
+
+// Dumps the running configuration with secrets removed.
+func (s *Server) controlConfig(w http.ResponseWriter, req *http.Request) {
+	s.writeJSON(w, 200, map[string]interface{}{
+		"Config": s.getConf().Redacted(),
+		"Paused": s.workQueue.Paused(),
+	})
+}
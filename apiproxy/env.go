@@ -0,0 +1,86 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Environment variables starting with this override the config file. The
+// rest of the name is the field name in upper case, with nested fields joined
+// by underscores, such as APIPROXY_WORKERS or APIPROXY_LOGGING_LOGFILE.
+const envPrefix = "APIPROXY_"
+
+// Applies any environment overrides to the config.
+func applyEnv(c *Config) error {
+	return applyEnvStruct(reflect.ValueOf(c).Elem(), envPrefix)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + strings.ToUpper(t.Field(i).Name)
+
+		if field.Kind() == reflect.Struct {
+			err := applyEnvStruct(field, name+"_")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setEnvField(field, value)
+		if err != nil {
+			return fmt.Errorf("Invalid %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Lists of strings are comma separated, other lists are given as JSON.
+func setEnvField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			var list []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		list := reflect.New(field.Type())
+		err := json.Unmarshal([]byte(value), list.Interface())
+		if err != nil {
+			return err
+		}
+		field.Set(list.Elem())
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
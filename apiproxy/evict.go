@@ -0,0 +1,91 @@
+package apiproxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CacheLimits bounds the size of a cache, zero values mean no limit.
+type CacheLimits struct {
+	MaxBytes   int64
+	MaxEntries int
+
+	// Either "lru" or "lfu", decides which entries go first once expired
+	// entries are gone.
+	Policy string
+}
+
+func validEvictionPolicy(policy string) error {
+	switch strings.ToLower(policy) {
+	case "", "lru", "lfu":
+		return nil
+	}
+	return fmt.Errorf("Unknown eviction policy %s", policy)
+}
+
+// Once over a limit we evict down to this fraction of it, so a full cache
+// doesn't need to evict on every single store.
+const evictionLowWater = 0.9
+
+type evictionCandidate struct {
+	tag string
+	CacheEntry
+}
+
+// Removes entries until the cache is within its limits, returning the number
+// evicted. The entry tagged keep, the one just stored, is left alone as it
+// hasn't had a chance to be used yet. Must be called with the lock held.
+func (d *DiskCache) evict(keep string) int {
+	overBytes := d.limits.MaxBytes > 0 && d.cacheBytes > d.limits.MaxBytes
+	overEntries := d.limits.MaxEntries > 0 && len(d.cacheFiles) > d.limits.MaxEntries
+	if !overBytes && !overEntries {
+		return 0
+	}
+
+	targetBytes := int64(float64(d.limits.MaxBytes) * evictionLowWater)
+	targetEntries := int(float64(d.limits.MaxEntries) * evictionLowWater)
+
+	candidates := make([]evictionCandidate, 0, len(d.cacheFiles))
+	for tag, ce := range d.cacheFiles {
+		if tag != keep {
+			candidates = append(candidates, evictionCandidate{tag, ce})
+		}
+	}
+
+	now := time.Now()
+	lfu := strings.ToLower(d.limits.Policy) == "lfu"
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		// Expired entries always go first.
+		aExpired, bExpired := now.After(a.Expires), now.After(b.Expires)
+		if aExpired != bExpired {
+			return aExpired
+		}
+		if lfu && a.Hits != b.Hits {
+			return a.Hits < b.Hits
+		}
+		return a.LastAccess.Before(b.LastAccess)
+	})
+
+	evicted := 0
+	for _, c := range candidates {
+		bytesOK := d.limits.MaxBytes <= 0 || d.cacheBytes <= targetBytes
+		entriesOK := d.limits.MaxEntries <= 0 || len(d.cacheFiles) <= targetEntries
+		if bytesOK && entriesOK {
+			break
+		}
+
+		os.Remove(d.filename(c.tag))
+		d.remove(c.tag)
+		evicted++
+	}
+
+	atomic.AddInt64(&d.evictions, int64(evicted))
+	d.debugLog.Printf("Evicted %d entries, cache now %d entries and %d bytes.", evicted, len(d.cacheFiles), d.cacheBytes)
+	return evicted
+}
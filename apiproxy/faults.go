@@ -0,0 +1,149 @@
+package apiproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+// Fault injection lets clients be tested against the failures the proxy can
+// produce. Faults come from the configured rules, or from the fault header
+// when one is configured.
+
+// Most latency the fault header can ask for.
+const maxHeaderLatency = 30 * time.Second
+
+type faults struct {
+	latency   time.Duration
+	errorCode int
+	truncate  bool
+	reset     bool
+}
+
+func validateFaults(c FaultConfig) error {
+	for _, r := range c.Rules {
+		if r.Rate < 0 || r.Rate > 1 {
+			return fmt.Errorf("Faults.Rule rate %g for %s must be between 0 and 1", r.Rate, r.Endpoint)
+		}
+		switch strings.ToLower(r.Type) {
+		case "latency":
+			if r.Latency <= 0 {
+				return fmt.Errorf("Faults.Rule latency for %s needs a latency", r.Endpoint)
+			}
+		case "error":
+			if r.Code == 0 {
+				return fmt.Errorf("Faults.Rule error for %s needs a code", r.Endpoint)
+			}
+		case "truncate", "reset":
+		default:
+			return fmt.Errorf("Unknown Faults.Rule type %s", r.Type)
+		}
+	}
+	return nil
+}
+
+// Rules apply to an exact page or every page under a prefix ending in /.
+func faultMatches(endpoint, url string) bool {
+	endpoint = strings.ToLower(endpoint)
+	if endpoint == "" || endpoint == url {
+		return true
+	}
+	return strings.HasSuffix(endpoint, "/") && strings.HasPrefix(url, endpoint)
+}
+
+func (f *faults) add(kind string, latency time.Duration, code int) {
+	switch strings.ToLower(kind) {
+	case "latency":
+		f.latency += latency
+	case "error":
+		f.errorCode = code
+	case "truncate":
+		f.truncate = true
+	case "reset":
+		f.reset = true
+	}
+}
+
+// Decides which faults to inject into a request for url.
+func pickFaults(conf *Config, req *http.Request, url string) faults {
+	var f faults
+	url = strings.ToLower(url)
+
+	for _, r := range conf.Faults.Rules {
+		if faultMatches(r.Endpoint, url) && rand.Float64() < r.Rate {
+			f.add(r.Type, time.Duration(r.Latency)*time.Millisecond, r.Code)
+		}
+	}
+
+	// The header lists faults such as "latency=500, error=221, truncate".
+	if conf.Faults.Header != "" {
+		var latency time.Duration
+		for _, part := range strings.Split(req.Header.Get(conf.Faults.Header), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			var n int
+			if len(kv) == 2 {
+				n, _ = strconv.Atoi(kv[1])
+			}
+			if strings.EqualFold(kv[0], "latency") {
+				if n > 0 {
+					latency += time.Duration(n) * time.Millisecond
+				}
+				continue
+			}
+			f.add(kv[0], 0, n)
+		}
+		// Anyone able to send the header shouldn't be able to tie up a
+		// connection for as long as they like.
+		if latency > maxHeaderLatency {
+			latency = maxHeaderLatency
+		}
+		f.latency += latency
+	}
+	return f
+}
+
+// Builds the response for an injected error. 504 is the proxy's own rate
+// limit timeout, everything else looks like it came from the API.
+func faultResponse(code int) *apicache.Response {
+	if code == 504 {
+		errStr := "APIProxy Error: Proxy timeout due to rate limiting."
+		return &apicache.Response{
+			Data:     apicache.SynthesizeAPIError(500, errStr, 5*time.Minute),
+			Expires:  time.Now().Add(5 * time.Minute),
+			Error:    apicache.APIError{ErrorCode: 500, ErrorText: errStr},
+			HTTPCode: 504,
+		}
+	}
+
+	code, httpCode, text := simulatedError(code)
+	return &apicache.Response{
+		Data:     apicache.SynthesizeAPIError(code, text, time.Minute),
+		Expires:  time.Now().Add(time.Minute),
+		Error:    apicache.APIError{ErrorCode: code, ErrorText: text},
+		HTTPCode: httpCode,
+	}
+}
+
+// Drops the client's connection without a response, with a TCP reset where
+// possible. Connections that can't be hijacked, such as HTTP/2 streams, are
+// aborted by net/http instead.
+func resetConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,105 @@
+package apiproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultHeaderLatencyCapped(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Faults.Header = "X-Proxy-Fault"
+
+	req := httptest.NewRequest("GET", "/eve/CharacterName.xml.aspx", nil)
+	req.Header.Set("X-Proxy-Fault", "latency=86400000, latency=1000, latency=-5000, error=221")
+	f := pickFaults(&conf, req, req.URL.Path)
+	if f.latency != maxHeaderLatency || f.errorCode != 221 {
+		t.Errorf("Got latency %s and error %d, expected %s and 221", f.latency, f.errorCode, maxHeaderLatency)
+	}
+
+	req.Header.Set("X-Proxy-Fault", "latency=-5000")
+	if f := pickFaults(&conf, req, req.URL.Path); f.latency != 0 {
+		t.Errorf("Negative latency gave %s", f.latency)
+	}
+}
+
+func TestResetConnection(t *testing.T) {
+	// Without a connection to take over the handler is aborted.
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Reset without a hijacker gave %v, expected http.ErrAbortHandler", r)
+			}
+		}()
+		resetConnection(httptest.NewRecorder())
+	}()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resetConnection(w)
+	}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("Reset connection answered with HTTP %d", resp.StatusCode)
+	}
+}
+
+func TestFaultTruncateGzip(t *testing.T) {
+	// Big enough for the cache to compress.
+	rows := strings.Repeat(`<row characterID="1" />`, 100)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now().UTC()
+		fmt.Fprintf(w, `<?xml version='1.0' encoding='UTF-8'?>
+<eveapi version="2"><currentTime>%s</currentTime><result>%s</result><cachedUntil>%s</cachedUntil></eveapi>`,
+			now.Format("2006-01-02 15:04:05"), rows, now.Add(time.Hour).Format("2006-01-02 15:04:05"))
+	}))
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := DefaultConfig()
+	conf.Workers = 1
+	conf.CacheDir = dir
+	conf.CacheCompression = "gzip"
+	conf.Faults.Header = "X-Proxy-Fault"
+	conf.Upstreams = []UpstreamConfig{{Name: "test", BaseURL: api.URL, PathPrefix: "/test"}}
+	s, err := NewServer(WithConfig(conf), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer shutdownTestServer(t, s)
+
+	get := func(encoding, fault string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/test/account/characters.xml.aspx", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		req.Header.Set("X-Proxy-Fault", fault)
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := get("", "").Body.Bytes()
+	if w := get("gzip", ""); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Cached page not passed through gzipped")
+	}
+
+	w := get("gzip", "truncate")
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Truncated page sent with Content-Encoding %s", w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.Len() == 0 || w.Body.Len() >= len(plain) || !bytes.HasPrefix(plain, w.Body.Bytes()) {
+		t.Errorf("Truncated page of %d bytes isn't the start of the %d byte page", w.Body.Len(), len(plain))
+	}
+}
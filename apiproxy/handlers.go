@@ -1,38 +1,39 @@
-package main
+package apiproxy
 
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 
 	"github.com/inominate/apicache"
 )
 
-// Prototype for page specific handlers.
-type APIHandler func(url string, params map[string]string) *apicache.Response
+// Prototype for page specific handlers. They return the response along with
+// how the request that produced it was answered.
+type APIHandler func(s *Server, url string, params map[string]string) (*apicache.Response, reqResult)
 
 // Default straight through handler.
-func defaultHandler(url string, params map[string]string) *apicache.Response {
-	resp, err := APIReq(url, params)
+func (s *Server) defaultHandler(url string, params map[string]string) (*apicache.Response, reqResult) {
+	resp, result, err := s.apiReq(url, params)
 	if err != nil {
-		debugLog.Printf("API Error %s: %s - %+v", err, url, params)
+		s.debugLog.Printf("API Error %s: %s%s", err, url, formatLogParams(params, s.getConf().Logging.CensorLog))
 	}
 
-	return resp
+	return resp, result
 }
 
 // Handler for recovering from bogus 221s
-func randomErrorHandler(url string, params map[string]string) *apicache.Response {
+func (s *Server) randomErrorHandler(url string, params map[string]string) (*apicache.Response, reqResult) {
 	var resp *apicache.Response
+	var result reqResult
 	var err error
 	attempts := 0
 
-	for ; attempts < conf.Retries; attempts++ {
-		resp, err = APIReq(url, params)
+	for ; attempts < s.getConf().Retries; attempts++ {
+		resp, result, err = s.apiReq(url, params)
 		if err != nil {
-			debugLog.Printf("API Error %s: %s - %+v", err, url, params)
+			s.debugLog.Printf("API Error %s: %s%s", err, url, formatLogParams(params, s.getConf().Logging.CensorLog))
 		}
 		if resp.Error.ErrorCode != 221 {
 			break
@@ -40,20 +41,19 @@ func randomErrorHandler(url string, params map[string]string) *apicache.Response
 	}
 
 	if resp.Error.ErrorCode == 221 {
-		log.Printf("Failed to recover from error 221.")
+		s.log.Printf("Failed to recover from error 221.")
 	} else if attempts > 0 {
-		log.Printf("Recovered from error 221 on retry %d.", attempts)
+		s.log.Printf("Recovered from error 221 on retry %d.", attempts)
 	}
-	return resp
+	return resp, result
 }
 
 // Defines valid API pages and what special handler they should use.
 // nil handlers will attempt to use defaultHandler which is a straight
 // passthrough.
 var validPages = map[string]APIHandler{
-	//	"/control/":                             controlHandler,
 	"/account/accountstatus.xml.aspx": nil,
-	"/account/apikeyinfo.xml.aspx":    randomErrorHandler,
+	"/account/apikeyinfo.xml.aspx":    (*Server).randomErrorHandler,
 	"/account/characters.xml.aspx":    nil,
 
 	"/char/accountbalance.xml.aspx":         nil,
@@ -74,14 +74,14 @@ var validPages = map[string]APIHandler{
 	"/char/industryjobshistory.xml.aspx":    nil,
 	"/char/killlog.xml.aspx":                nil,
 	"/char/killmails.xml.aspx":              nil,
-	"/char/locations.xml.aspx":              idsListHandler,
-	"/char/mailbodies.xml.aspx":             idsListHandler,
+	"/char/locations.xml.aspx":              (*Server).idsListHandler,
+	"/char/mailbodies.xml.aspx":             (*Server).idsListHandler,
 	"/char/mailinglists.xml.aspx":           nil,
 	"/char/mailmessages.xml.aspx":           nil,
 	"/char/marketorders.xml.aspx":           nil,
 	"/char/medals.xml.aspx":                 nil,
 	"/char/notifications.xml.aspx":          nil,
-	"/char/notificationtexts.xml.aspx":      idsListHandler,
+	"/char/notificationtexts.xml.aspx":      (*Server).idsListHandler,
 	"/char/planetarycolonies.xml.aspx":      nil,
 	"/char/planetarylinks.xml.aspx":         nil,
 	"/char/planetarypins.xml.aspx":          nil,
@@ -111,7 +111,7 @@ var validPages = map[string]APIHandler{
 	"/corp/industryjobshistory.xml.aspx":  nil,
 	"/corp/killlog.xml.aspx":              nil,
 	"/corp/killmails.xml.aspx":            nil,
-	"/corp/locations.xml.aspx":            idsListHandler,
+	"/corp/locations.xml.aspx":            (*Server).idsListHandler,
 	"/corp/marketorders.xml.aspx":         nil,
 	"/corp/medals.xml.aspx":               nil,
 	"/corp/membermedals.xml.aspx":         nil,
@@ -129,7 +129,7 @@ var validPages = map[string]APIHandler{
 	"/corp/wallettransactions.xml.aspx":   nil,
 
 	"/eve/alliancelist.xml.aspx":           nil,
-	"/eve/characteraffiliation.xml.aspx":   idsListHandler,
+	"/eve/characteraffiliation.xml.aspx":   (*Server).idsListHandler,
 	"/eve/characterid.xml.aspx":            nil,
 	"/eve/characterinfo.xml.aspx":          nil,
 	"/eve/charactername.xml.aspx":          nil,
@@ -165,16 +165,16 @@ const maxIDErrors = 16
 // Note: Can generate many errors so should only be used with applications
 // that know to behave themselves. Add a form value of fix with any content
 // to enable the correction.
-func idsListHandler(url string, params map[string]string) *apicache.Response {
+func (s *Server) idsListHandler(url string, params map[string]string) (*apicache.Response, reqResult) {
 	var runFixer bool
 	runFixer = true
 
-	resp, err := APIReq(url, params)
+	resp, result, err := s.apiReq(url, params)
 	if err != nil {
-		debugLog.Printf("API Error %s: %s - %+v", err, url, params)
+		s.debugLog.Printf("API Error %s: %s%s", err, url, formatLogParams(params, s.getConf().Logging.CensorLog))
 	}
 	if !runFixer {
-		return resp
+		return resp, result
 	}
 
 	var ids []string
@@ -186,25 +186,25 @@ func idsListHandler(url string, params map[string]string) *apicache.Response {
 	// If there's more than 250 ids, that's beyond the API limit so we won't
 	// touch that either.
 	if len(ids) == 0 || len(ids) == 1 || len(ids) > 250 {
-		return resp
+		return resp, result
 	}
 	// If the request didn't have an invalid id, errorcode 135, there's nothing
 	// we can do to help.
 	if resp.Error.ErrorCode != 135 {
-		return resp
+		return resp, result
 	}
 
 	// If we got this far there's more than one ID, at least one of which is
 	// invalid.
-	debugLog.Printf("idsListHandler going into action for %d ids: %s", len(ids), params["ids"])
+	s.debugLog.Printf("idsListHandler going into action for %d ids: %s", len(ids), params["ids"])
 
 	var errCount errCount
 	delete(params, "ids")
 
-	validIDs, err := findValidIDs(url, params, ids, &errCount)
+	validIDs, err := s.findValidIDs(url, params, ids, &errCount)
 	if err != nil {
-		debugLog.Printf("findValidIDs failed: %s", err)
-		return resp
+		s.debugLog.Printf("findValidIDs failed: %s", err)
+		return resp, result
 	}
 
 	idsBuf := &bytes.Buffer{}
@@ -215,12 +215,12 @@ func idsListHandler(url string, params map[string]string) *apicache.Response {
 	idsParam := idsBuf.String()
 	params["ids"] = idsParam
 
-	resp, err = APIReq(url, params)
+	resp, result, err = s.apiReq(url, params)
 	if err != nil {
-		debugLog.Printf("API Error %s: %s - %+v", err, url, params)
+		s.debugLog.Printf("API Error %s: %s%s", err, url, formatLogParams(params, s.getConf().Logging.CensorLog))
 	}
-	debugLog.Printf("Completed with: %d errors.", errCount.Get())
-	return resp
+	s.debugLog.Printf("Completed with: %d errors.", errCount.Get())
+	return resp, result
 }
 
 type errCount struct {
@@ -245,9 +245,9 @@ func (e *errCount) Add() int {
 	return count
 }
 
-func findValidIDs(url string, params map[string]string, ids []string, errCount *errCount) ([]string, error) {
+func (s *Server) findValidIDs(url string, params map[string]string, ids []string, errCount *errCount) ([]string, error) {
 	if false && len(ids) == 1 {
-		valid, err := isValidIDList(url, params, ids, errCount)
+		valid, err := s.isValidIDList(url, params, ids, errCount)
 		if valid {
 			return ids, err
 		} else {
@@ -263,7 +263,7 @@ func findValidIDs(url string, params map[string]string, ids []string, errCount *
 	var leftErr, rightErr error
 
 	left := ids[0 : len(ids)/2]
-	leftValid, leftErr := isValidIDList(url, params, left, errCount)
+	leftValid, leftErr := s.isValidIDList(url, params, left, errCount)
 	if leftErr != nil {
 		return nil, leftErr
 	}
@@ -271,7 +271,7 @@ func findValidIDs(url string, params map[string]string, ids []string, errCount *
 		leftIDs = left
 	} else {
 		if len(left) > 1 {
-			leftIDs, leftErr = findValidIDs(url, params, left, errCount)
+			leftIDs, leftErr = s.findValidIDs(url, params, left, errCount)
 			if rightErr != nil {
 				return nil, leftErr
 			}
@@ -279,7 +279,7 @@ func findValidIDs(url string, params map[string]string, ids []string, errCount *
 	}
 
 	right := ids[len(ids)/2:]
-	rightValid, rightErr := isValidIDList(url, params, right, errCount)
+	rightValid, rightErr := s.isValidIDList(url, params, right, errCount)
 	if rightErr != nil {
 		return nil, rightErr
 	}
@@ -287,7 +287,7 @@ func findValidIDs(url string, params map[string]string, ids []string, errCount *
 		rightIDs = right
 	} else {
 		if len(right) > 1 {
-			rightIDs, rightErr = findValidIDs(url, params, right, errCount)
+			rightIDs, rightErr = s.findValidIDs(url, params, right, errCount)
 			if rightErr != nil {
 				return nil, rightErr
 			}
@@ -298,7 +298,7 @@ func findValidIDs(url string, params map[string]string, ids []string, errCount *
 	return validIDs, nil
 }
 
-func isValidIDList(url string, params map[string]string, ids []string, errCount *errCount) (bool, error) {
+func (s *Server) isValidIDList(url string, params map[string]string, ids []string, errCount *errCount) (bool, error) {
 	if count := errCount.Get(); count >= maxIDErrors {
 		return false, fmt.Errorf("failed to get ids, hit %d errors limit", count)
 	}
@@ -316,7 +316,7 @@ func isValidIDList(url string, params map[string]string, ids []string, errCount
 	}
 	newParams["ids"] = idsParam
 
-	resp, err := APIReq(url, newParams)
+	resp, err := s.APIReq(url, newParams)
 	// Bail completely if the API itself fails for any reason.
 	if err != nil {
 		return false, err
@@ -330,7 +330,7 @@ func isValidIDList(url string, params map[string]string, ids []string, errCount
 		return false, resp.Error
 	}
 
-	debugLog.Printf("Adding Error %d for: %v", errCount.Get(), ids)
+	s.debugLog.Printf("Adding Error %d for: %v", errCount.Get(), ids)
 	errCount.Add()
 
 	return false, nil
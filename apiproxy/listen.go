@@ -0,0 +1,118 @@
+package apiproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The listeners to serve on, Listen on its own if none are configured.
+func configListeners(c Config) []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{Type: "tcp", Addr: c.Listen}}
+}
+
+func validateListeners(c Config) error {
+	for _, l := range configListeners(c) {
+		if l.Addr == "" {
+			return fmt.Errorf("Listener needs an Addr")
+		}
+		switch strings.ToLower(l.Type) {
+		case "", "tcp":
+		case "unix":
+			if l.Mode != "" {
+				_, err := strconv.ParseUint(l.Mode, 8, 32)
+				if err != nil {
+					return fmt.Errorf("Invalid Listener Mode %s for %s", l.Mode, l.Addr)
+				}
+			}
+		case "tls":
+			if l.Cert == "" || l.Key == "" {
+				return fmt.Errorf("TLS Listener %s needs a Cert and Key", l.Addr)
+			}
+		default:
+			return fmt.Errorf("Unknown Listener Type %s for %s", l.Type, l.Addr)
+		}
+	}
+	return nil
+}
+
+// Opens the listener, ready to be served.
+func (l ListenerConfig) listen() (net.Listener, error) {
+	switch strings.ToLower(l.Type) {
+	case "unix":
+		return listenUnix(l.Addr, l.Mode)
+	case "tls":
+		tlsConfig, err := l.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(ln, tlsConfig), nil
+	}
+	return net.Listen("tcp", l.Addr)
+}
+
+// Listens on a unix socket, replacing any left behind by an earlier run.
+func listenUnix(path, mode string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != "" {
+		perm, _ := strconv.ParseUint(mode, 8, 32)
+		err = os.Chmod(path, os.FileMode(perm))
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+func (l ListenerConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if l.ClientCA != "" {
+		pem, err := ioutil.ReadFile(l.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", l.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func (l ListenerConfig) String() string {
+	if l.Type == "" {
+		return "tcp " + l.Addr
+	}
+	return strings.ToLower(l.Type) + " " + l.Addr
+}
@@ -0,0 +1,289 @@
+package apiproxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix format for rotated log files, sorts in age order. Files rotated in
+// the same millisecond get a -N sequence number after it.
+const logRotateFormat = "2006-01-02T15-04-05.000"
+
+// A log file that rotates itself by size or age and can be reopened after
+// being moved by an external tool.
+type logFile struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	backups  int
+	compress bool
+
+	fp   *os.File
+	size int64
+	// When the current file was started, as near as can be told.
+	created time.Time
+
+	cleanupLock sync.Mutex
+	sync.Mutex
+}
+
+func openLogFile(path string, c LogConfig) (*logFile, error) {
+	l := &logFile{
+		path:     path,
+		maxBytes: int64(c.MaxSize) * 1024 * 1024,
+		maxAge:   time.Duration(c.MaxAge) * time.Hour,
+		backups:  c.MaxBackups,
+		compress: c.Compress,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Opens the log file and switches to it, closing any file already open. On
+// failure the current file is kept.
+func (l *logFile) open() error {
+	fp, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	if l.fp != nil {
+		l.fp.Close()
+	}
+	l.fp = fp
+	l.size = info.Size()
+	l.created = l.startTime(info.Size())
+	return nil
+}
+
+// Works out when the file just opened was started. An empty file starts now,
+// otherwise it was started when the last one was rotated. A file with no
+// rotated ones is of unknown age and counts as old enough to rotate.
+func (l *logFile) startTime(size int64) time.Time {
+	if size == 0 || l.maxAge == 0 {
+		return time.Now()
+	}
+	matches, err := l.rotated()
+	if err != nil || len(matches) == 0 {
+		return time.Time{}
+	}
+	stamp, _ := rotatedStamp(rotatedPattern(filepath.Base(l.path)), matches[len(matches)-1])
+	return stamp
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.fp == nil {
+		return 0, fmt.Errorf("log file %s is closed", l.path)
+	}
+
+	full := l.maxBytes > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxBytes
+	old := l.maxAge > 0 && time.Since(l.created) > l.maxAge
+	if full || old {
+		err := l.rotate()
+		if err != nil {
+			// Keep logging to whatever we have rather than losing lines.
+			fmt.Fprintf(os.Stderr, "Log rotation of %s failed: %s\n", l.path, err)
+		}
+	}
+
+	n, err := l.fp.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Moves the current file aside and starts a new one, must be called with the
+// lock held.
+func (l *logFile) rotate() error {
+	err := os.Rename(l.path, l.rotatedName(time.Now()))
+	if err == nil {
+		// Until this works logging carries on in the rotated file.
+		err = l.open()
+	}
+	if err != nil {
+		l.created = time.Now()
+		return err
+	}
+
+	go l.cleanup()
+	return nil
+}
+
+// Picks a name to rotate the log to that isn't taken, compressed or not.
+func (l *logFile) rotatedName(now time.Time) string {
+	name := l.path + "." + now.Format(logRotateFormat)
+	for seq := 1; ; seq++ {
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+		name = fmt.Sprintf("%s.%s-%d", l.path, now.Format(logRotateFormat), seq)
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return !os.IsNotExist(err)
+}
+
+// Compresses rotated files and removes those beyond the retention count.
+func (l *logFile) cleanup() {
+	l.cleanupLock.Lock()
+	defer l.cleanupLock.Unlock()
+
+	matches, err := l.rotated()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Log cleanup of %s failed: %s\n", l.path, err)
+		return
+	}
+
+	if l.backups > 0 && len(matches) > l.backups {
+		for _, name := range matches[:len(matches)-l.backups] {
+			os.Remove(name)
+		}
+		matches = matches[len(matches)-l.backups:]
+	}
+
+	if !l.compress {
+		return
+	}
+	for _, name := range matches {
+		if strings.HasSuffix(name, ".gz") {
+			continue
+		}
+		err := gzipFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Log compression of %s failed: %s\n", name, err)
+		}
+	}
+}
+
+// Finds the files rotate has moved the log to, oldest first. Anything else
+// next to the log, such as proxy.log.debug for proxy.log, is left alone.
+func (l *logFile) rotated() ([]string, error) {
+	dir, base := filepath.Split(l.path)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := rotatedPattern(base)
+	var matches []string
+	for _, f := range files {
+		if f.Mode().IsRegular() && pattern.MatchString(f.Name()) {
+			matches = append(matches, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		ti, si := rotatedStamp(pattern, matches[i])
+		tj, sj := rotatedStamp(pattern, matches[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return si < sj
+	})
+	return matches, nil
+}
+
+// Matches the names rotate gives the log file base, capturing the time and
+// sequence number.
+func rotatedPattern(base string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(base) + `\.(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}\.\d{3})(?:-(\d+))?(?:\.gz)?$`)
+}
+
+// Returns when a rotated file was rotated and its sequence number.
+func rotatedStamp(pattern *regexp.Regexp, name string) (time.Time, int) {
+	m := pattern.FindStringSubmatch(filepath.Base(name))
+	if m == nil {
+		return time.Time{}, 0
+	}
+	stamp, _ := time.ParseInLocation(logRotateFormat, m[1], time.Local)
+	seq, _ := strconv.Atoi(m[2])
+	return stamp, seq
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Reopens the file, picking up a new one if it has been moved. If that fails
+// logging carries on in the old one.
+func (l *logFile) Reopen() error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.open()
+}
+
+func (l *logFile) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.fp == nil {
+		return nil
+	}
+	err := l.fp.Close()
+	l.fp = nil
+	return err
+}
+
+// ReopenLogs reopens the server's log files, for use after external rotation.
+func (s *Server) ReopenLogs() {
+	s.logFilesLock.Lock()
+	defer s.logFilesLock.Unlock()
+
+	for _, l := range s.logFiles {
+		err := l.Reopen()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot reopen log file %s: %s\n", l.path, err)
+			continue
+		}
+	}
+	s.log.Printf("Log files reopened.")
+}
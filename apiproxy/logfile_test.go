@@ -0,0 +1,168 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLogCleanupOnlyTouchesRotatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.log")
+	l, err := openLogFile(path, LogConfig{MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, name := range []string{
+		"proxy.log.debug",
+		"proxy.log.old",
+		"proxy.log.2016-01-01T00-00-00.000.gz",
+		"proxy.log.2016-01-02T00-00-00.000.gz",
+		"proxy.log.2016-01-03T00-00-00.000",
+		"other.log.2016-01-01T00-00-00.000",
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("log\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.cleanup()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+
+	expected := []string{
+		"other.log.2016-01-01T00-00-00.000",
+		"proxy.log",
+		"proxy.log.2016-01-02T00-00-00.000.gz",
+		"proxy.log.2016-01-03T00-00-00.000.gz",
+		"proxy.log.debug",
+		"proxy.log.old",
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Got files %q, expected %q", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("Got files %q, expected %q", names, expected)
+		}
+	}
+}
+
+func TestLogReopenKeepsFileOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.log")
+	l, err := openLogFile(path, LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A directory where the log should be can't be opened.
+	os.Remove(path)
+	os.Mkdir(path, 0700)
+	if err := l.Reopen(); err == nil {
+		t.Errorf("Reopen over a directory succeeded")
+	}
+	if _, err := l.Write([]byte("log\n")); err != nil {
+		t.Errorf("Write after failed Reopen: %s", err)
+	}
+}
+
+func TestLogRotatedNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.log")
+	l := &logFile{path: path}
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.Local)
+	stamp := path + "." + now.Format(logRotateFormat)
+
+	for _, expected := range []string{stamp, stamp + "-1", stamp + "-2"} {
+		name := l.rotatedName(now)
+		if name != expected {
+			t.Fatalf("Rotated to %s, expected %s", name, expected)
+		}
+		// Compressed ones count as taken too.
+		if err := ioutil.WriteFile(name+".gz", nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ioutil.WriteFile(path+".2016-01-01T00-00-00.000", nil, 0600)
+	matches, err := l.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{path + ".2016-01-01T00-00-00.000", stamp + ".gz", stamp + "-1.gz", stamp + "-2.gz"}
+	if fmt.Sprint(matches) != fmt.Sprint(expected) {
+		t.Errorf("Rotated files in order %q, expected %q", matches, expected)
+	}
+}
+
+func TestLogMaxAgeFromFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The log was started when the previous one was rotated two hours ago,
+	// restarting doesn't make it any younger.
+	path := filepath.Join(dir, "proxy.log")
+	rotated := path + "." + time.Now().Add(-2*time.Hour).Format(logRotateFormat)
+	ioutil.WriteFile(rotated, []byte("old\n"), 0600)
+	ioutil.WriteFile(path, []byte("current\n"), 0600)
+
+	l, err := openLogFile(path, LogConfig{MaxAge: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Write([]byte("new\n"))
+	matches, err := l.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("Got rotated files %q, expected the current log rotated", matches)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "new\n" {
+		t.Errorf("Log has %q after rotation", data)
+	}
+
+	// A fresh file is as old as its first line.
+	l.Write([]byte("newer\n"))
+	if matches, _ := l.rotated(); len(matches) != 2 {
+		t.Errorf("New log rotated again: %q", matches)
+	}
+}
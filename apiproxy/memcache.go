@@ -0,0 +1,190 @@
+package apiproxy
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	tag  string
+	data []byte
+	CacheEntry
+}
+
+// MemoryCache keeps cache entries in process memory, discarding the least
+// recently used entry once maxEntries is reached.
+type MemoryCache struct {
+	maxEntries int
+	retain     time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	debugLog   *log.Logger
+	// Closed to stop the expired entry purger.
+	done chan struct{}
+	sync.Mutex
+}
+
+func (m *MemoryCache) expiredPurger() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(30 * time.Minute):
+		}
+
+		m.debugLog.Printf("Cleaning Up.")
+		now := time.Now()
+
+		m.Lock()
+		collectcount := 0
+		for tag, el := range m.entries {
+			if now.After(el.Value.(*memoryEntry).Expires.Add(m.retain)) {
+				m.lru.Remove(el)
+				delete(m.entries, tag)
+
+				collectcount++
+			}
+		}
+		m.Unlock()
+		m.debugLog.Printf("Collected %d expired entries.", collectcount)
+	}
+}
+
+// Close stops the expired entry purger, the entries stay available.
+func (m *MemoryCache) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Store(cacheTag string, HTTPCode int, data []byte, Expires time.Time) error {
+	return m.StoreKeyed(cacheTag, "", HTTPCode, data, Expires)
+}
+
+func (m *MemoryCache) StoreKeyed(cacheTag string, key string, HTTPCode int, data []byte, Expires time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	me := &memoryEntry{cacheTag, data, CacheEntry{HTTPCode: HTTPCode, Expires: Expires, Key: key, LastAccess: time.Now()}}
+	if el, exists := m.entries[cacheTag]; exists {
+		// Refreshed entries keep their hits.
+		me.Hits = el.Value.(*memoryEntry).Hits
+		el.Value = me
+		m.lru.MoveToFront(el)
+		return nil
+	}
+
+	m.entries[cacheTag] = m.lru.PushFront(me)
+	for m.lru.Len() > m.maxEntries {
+		el := m.lru.Back()
+		m.lru.Remove(el)
+		delete(m.entries, el.Value.(*memoryEntry).tag)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Get(cacheTag string) (int, []byte, time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	el, exists := m.entries[cacheTag]
+	if !exists {
+		return 0, nil, time.Time{}, fmt.Errorf("Not cached.")
+	}
+
+	me := el.Value.(*memoryEntry)
+	if time.Now().After(me.Expires.Add(m.retain)) {
+		m.lru.Remove(el)
+		delete(m.entries, cacheTag)
+		return 0, nil, me.Expires, fmt.Errorf("Not cached.")
+	}
+
+	m.lru.MoveToFront(el)
+	me.LastAccess = time.Now()
+	me.Hits++
+	return me.HTTPCode, me.data, me.Expires, nil
+}
+
+func (m *MemoryCache) Purge(cacheTag string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	el, exists := m.entries[cacheTag]
+	if !exists {
+		return 0, nil
+	}
+	m.lru.Remove(el)
+	delete(m.entries, cacheTag)
+	return 1, nil
+}
+
+func (m *MemoryCache) PurgeMatching(match func(key string) bool) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	count := 0
+	for tag, el := range m.entries {
+		if match(el.Value.(*memoryEntry).Key) {
+			m.lru.Remove(el)
+			delete(m.entries, tag)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryCache) Size() (int, int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	var size int64
+	for _, el := range m.entries {
+		size += int64(len(el.Value.(*memoryEntry).data))
+	}
+	return len(m.entries), size
+}
+
+func (m *MemoryCache) LogStats(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	entries := 0
+	expired := 0
+	size := 0
+
+	now := time.Now()
+	for _, el := range m.entries {
+		me := el.Value.(*memoryEntry)
+		entries++
+		size += len(me.data)
+		if now.After(me.Expires) {
+			expired++
+		}
+	}
+
+	fmt.Fprintf(w, "Cache Entries: %d/%d  Expired Entries: %d  Size: %dkb\n", entries, m.maxEntries, expired, size/1024)
+}
+
+func NewMemoryCache(maxEntries int, retain time.Duration, debugLog *log.Logger) *MemoryCache {
+	var mc MemoryCache
+
+	mc.maxEntries = maxEntries
+	mc.retain = retain
+	mc.entries = make(map[string]*list.Element)
+	mc.lru = list.New()
+	mc.debugLog = orDiscard(debugLog)
+	mc.done = make(chan struct{})
+
+	go mc.expiredPurger()
+	return &mc
+}
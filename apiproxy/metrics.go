@@ -0,0 +1,243 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exported in the Prometheus text format on /metrics.
+
+// A counter broken down by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	values map[string]float64
+	sync.Mutex
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	c.Lock()
+	c.values[key] += v
+	c.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Returns the value for one set of label values.
+func (c *counterVec) Get(labelValues ...string) float64 {
+	key := strings.Join(labelValues, "\x00")
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.values[key]
+}
+
+// Returns the sum across all label values.
+func (c *counterVec) Total() float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	var total float64
+	for _, v := range c.values {
+		total += v
+	}
+	return total
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var labelValues []string
+		if len(c.labels) > 0 {
+			labelValues = strings.Split(k, "\x00")
+		}
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, labelValues), c.values[k])
+	}
+}
+
+// A histogram of observations, in seconds for everything we time.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	counts []uint64
+	sum    float64
+	count  uint64
+	sync.Mutex
+}
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", l, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
+
+func writeCounter(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %g\n", name, help, name, name, v)
+}
+
+// A server's own metrics, everything else is read from its state when
+// written.
+type serverMetrics struct {
+	requests          *counterVec
+	apiErrors         *counterVec
+	cache             *counterVec
+	retries           *counterVec
+	rateLimitTimeouts *counterVec
+	faults            *counterVec
+
+	upstreamLatency *histogram
+	rateLimitWait   *histogram
+}
+
+func newServerMetrics() serverMetrics {
+	return serverMetrics{
+		requests: newCounterVec("apiproxy_requests_total",
+			"Requests served by endpoint and HTTP code.", "endpoint", "code"),
+		apiErrors: newCounterVec("apiproxy_api_errors_total",
+			"API errors returned to clients by error code.", "code"),
+		cache: newCounterVec("apiproxy_cache_requests_total",
+			"Cache lookups by result: hit, miss or stale.", "result"),
+		retries: newCounterVec("apiproxy_upstream_retries_total",
+			"Requests to the API retried after a failure."),
+		rateLimitTimeouts: newCounterVec("apiproxy_ratelimit_timeouts_total",
+			"Jobs that timed out waiting on a rate limiter.", "limiter"),
+		faults: newCounterVec("apiproxy_faults_injected_total",
+			"Faults injected into responses by type.", "type"),
+
+		upstreamLatency: newHistogram("apiproxy_upstream_duration_seconds",
+			"Time taken by requests to the API.", latencyBuckets),
+		rateLimitWait: newHistogram("apiproxy_ratelimit_wait_seconds",
+			"Time jobs spent waiting on the rate limiters.", latencyBuckets),
+	}
+}
+
+// SizedCache is implemented by backends that know how much they hold.
+type SizedCache interface {
+	Size() (entries int, bytes int64)
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
+
+func (s *Server) WriteMetrics(w io.Writer) {
+	s.metrics.requests.write(w)
+	s.metrics.apiErrors.write(w)
+	s.metrics.cache.write(w)
+	s.metrics.retries.write(w)
+	s.metrics.rateLimitTimeouts.write(w)
+	s.metrics.upstreamLatency.write(w)
+	s.metrics.rateLimitWait.write(w)
+	s.metrics.faults.write(w)
+
+	writeCounter(w, "apiproxy_coalesced_requests_total",
+		"Requests answered by an identical request already in flight.", float64(atomic.LoadInt64(&s.coalescedCount)))
+	writeCounter(w, "apiproxy_stale_responses_total",
+		"Stale responses served while refreshing.", float64(atomic.LoadInt64(&s.staleCount)))
+	writeCounter(w, "apiproxy_stale_error_responses_total",
+		"Stale responses served after API failures.", float64(atomic.LoadInt64(&s.staleErrorCount)))
+
+	active, loaded := s.GetWorkerStats()
+	writeGauge(w, "apiproxy_workers", "Number of running workers.", float64(loaded))
+	writeGauge(w, "apiproxy_workers_active", "Number of workers handling a job.", float64(active))
+
+	fmt.Fprintf(w, "# HELP apiproxy_worker_jobs_total Jobs handled by each worker.\n# TYPE apiproxy_worker_jobs_total counter\n")
+	counts := s.getWorkCounts()
+	for i := 1; i < len(counts); i++ {
+		fmt.Fprintf(w, "apiproxy_worker_jobs_total{worker=\"%d\"} %d\n", i, counts[i])
+	}
+
+	s.workQueue.writeMetrics(w)
+
+	rateLimiter, errorRateLimiter := s.getLimiters()
+	writeGauge(w, "apiproxy_ratelimit_requests", "Requests made in the last second.", float64(rateLimiter.Count()))
+	writeGauge(w, "apiproxy_ratelimit_errors", "Errors counted over the error period.", float64(errorRateLimiter.Count()))
+
+	if sc, ok := s.cache.(SizedCache); ok {
+		entries, bytes := sc.Size()
+		writeGauge(w, "apiproxy_cache_entries", "Entries held by the cache.", float64(entries))
+		writeGauge(w, "apiproxy_cache_bytes", "Bytes used by the cache.", float64(bytes))
+	}
+	if dc, ok := s.cache.(*DiskCache); ok {
+		writeCounter(w, "apiproxy_cache_evictions_total", "Entries evicted to stay within the cache limits.",
+			float64(atomic.LoadInt64(&dc.evictions)))
+	}
+}
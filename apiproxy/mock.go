@@ -0,0 +1,238 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+// Mock mode serves every valid page without going near the real API, for
+// testing the proxy and its clients offline. Errors are simulated on demand
+// with these parameters, which the proxy passes along like any other:
+//
+//	mockerror=221   respond with the given API error code, 418 for a tempban
+//	mockbadids=1,2  respond with error 135 if the ids parameter has any of these
+//	mockcache=60    seconds until the response expires
+const mockCacheTime = 5 * time.Minute
+
+// Most responses the mock remembers. Once full expired ones are dropped,
+// then whatever it takes to get back under three quarters of this.
+const mockMaxResponses = 10000
+
+const eveTimeFormat = "2006-01-02 15:04:05"
+
+// HTTP codes and text for the errors we know how to simulate.
+var mockErrors = map[int]struct {
+	httpCode int
+	text     string
+}{
+	135: {400, "Owner is not the owner of all itemIDs or a non-existant itemID was passed in."},
+	203: {403, "Authentication failure."},
+	221: {403, "Illegal page request! Please verify the access granted by the key you are using!"},
+	520: {500, "Unexpected failure accessing database."},
+	904: {418, "Your IP address has been temporarily blocked because it is causing too many errors. See the cacheUntil timestamp for when it will be opened again. IPs that continually cause a lot of errors in the API will be permanently banned, please take measures to minimize problematic API calls from your application."},
+}
+
+var (
+	currentTimeTag = regexp.MustCompile(`<currentTime>[^<]*</currentTime>`)
+	cachedUntilTag = regexp.MustCompile(`<cachedUntil>[^<]*</cachedUntil>`)
+)
+
+// A response handed out earlier, repeated until it expires like the real API.
+type mockResponse struct {
+	httpCode int
+	data     []byte
+	expires  time.Time
+}
+
+// MockServer is a handler serving every valid API page from fixtures or
+// generated responses, simulating errors on demand.
+type MockServer struct {
+	fixtures string
+	log      *log.Logger
+
+	responses    map[string]mockResponse
+	maxResponses int
+	sync.Mutex
+}
+
+// NewMockServer returns a MockServer serving fixtures from the given
+// directory, which may be left empty, and logging requests to logger.
+func NewMockServer(fixtures string, logger *log.Logger) *MockServer {
+	return &MockServer{
+		fixtures:     fixtures,
+		log:          orDiscard(logger),
+		responses:    make(map[string]mockResponse),
+		maxResponses: mockMaxResponses,
+	}
+}
+
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	url := strings.ToLower(path.Clean(req.URL.Path))
+	params := makeParams(req)
+
+	w.Header().Set("Content-Type", "text/xml")
+
+	if _, valid := validPages[url]; !valid {
+		w.WriteHeader(404)
+		w.Write(apicache.SynthesizeAPIError(404, "Invalid API page.", 24*time.Hour))
+		return
+	}
+
+	key := cacheTag(url, params)
+	m.Lock()
+	resp, ok := m.responses[key]
+	if !ok || time.Now().After(resp.expires) {
+		resp = m.respond(url, params)
+		if !ok && len(m.responses) >= m.maxResponses {
+			m.makeRoom()
+		}
+		m.responses[key] = resp
+	}
+	m.Unlock()
+
+	m.log.Printf("mock - %s%s - http: %d", url, formatLogParams(params, true), resp.httpCode)
+	w.WriteHeader(resp.httpCode)
+	w.Write(resp.data)
+}
+
+// Forgets responses to make room for more, must be called with the lock held.
+func (m *MockServer) makeRoom() {
+	now := time.Now()
+	for key, resp := range m.responses {
+		if now.After(resp.expires) {
+			delete(m.responses, key)
+		}
+	}
+	for key := range m.responses {
+		if len(m.responses) < m.maxResponses*3/4 {
+			break
+		}
+		delete(m.responses, key)
+	}
+}
+
+func (m *MockServer) respond(url string, params map[string]string) mockResponse {
+	cacheTime := mockCacheTime
+	if secs, err := strconv.Atoi(params["mockcache"]); err == nil && secs >= 0 {
+		cacheTime = time.Duration(secs) * time.Second
+	}
+
+	if code, err := strconv.Atoi(params["mockerror"]); err == nil {
+		return mockError(code, cacheTime)
+	}
+	if badIDs := params["mockbadids"]; badIDs != "" {
+		for _, id := range strings.Split(params["ids"], ",") {
+			for _, bad := range strings.Split(badIDs, ",") {
+				if strings.TrimSpace(id) == strings.TrimSpace(bad) {
+					return mockError(135, cacheTime)
+				}
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	data, fixtureCacheTime, err := m.fixture(url)
+	if err != nil {
+		data = generateMockXML(url, params)
+	} else if params["mockcache"] == "" && fixtureCacheTime > 0 {
+		cacheTime = fixtureCacheTime
+	}
+	expires := now.Add(cacheTime)
+
+	data = currentTimeTag.ReplaceAll(data, []byte("<currentTime>"+now.Format(eveTimeFormat)+"</currentTime>"))
+	data = cachedUntilTag.ReplaceAll(data, []byte("<cachedUntil>"+expires.Format(eveTimeFormat)+"</cachedUntil>"))
+	return mockResponse{200, data, expires}
+}
+
+// Looks up the API error code, HTTP code and text to simulate for code.
+func simulatedError(code int) (int, int, string) {
+	// A tempban is HTTP 418 with error 904, either will do.
+	if code == 418 {
+		code = 904
+	}
+	e, ok := mockErrors[code]
+	if !ok {
+		e.httpCode = 400
+		e.text = fmt.Sprintf("Simulated error %d.", code)
+	}
+	return code, e.httpCode, e.text
+}
+
+func mockError(code int, cacheTime time.Duration) mockResponse {
+	code, httpCode, text := simulatedError(code)
+	return mockResponse{httpCode, apicache.SynthesizeAPIError(code, text, cacheTime), time.Now().Add(cacheTime)}
+}
+
+// Reads the fixture for a page, found under the fixtures directory by its
+// path with or without the .aspx extension. Also returns how long the
+// fixture's own timestamps say it should be cached for.
+func (m *MockServer) fixture(url string) ([]byte, time.Duration, error) {
+	if m.fixtures == "" {
+		return nil, 0, os.ErrNotExist
+	}
+
+	name := filepath.Join(m.fixtures, filepath.FromSlash(url))
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(strings.TrimSuffix(name, ".aspx"))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var times struct {
+		CurrentTime string `xml:"currentTime"`
+		CachedUntil string `xml:"cachedUntil"`
+	}
+	xml.Unmarshal(data, &times)
+	current, err1 := time.Parse(eveTimeFormat, times.CurrentTime)
+	until, err2 := time.Parse(eveTimeFormat, times.CachedUntil)
+	if err1 != nil || err2 != nil {
+		return data, 0, nil
+	}
+	return data, until.Sub(current), nil
+}
+
+// Builds a response echoing the request for pages without a fixture.
+func generateMockXML(url string, params map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<?xml version='1.0' encoding='UTF-8'?>\n<eveapi version=\"2\">\n")
+	fmt.Fprintf(buf, "  <currentTime></currentTime>\n  <result>\n")
+	fmt.Fprintf(buf, "    <page>%s</page>\n", xmlEscape(url))
+	fmt.Fprintf(buf, "    <rowset name=\"params\" key=\"name\" columns=\"name,value\">\n")
+
+	logParams := logParamMap(params, true)
+	keys := make([]string, 0, len(logParams))
+	for k := range logParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "      <row name=\"%s\" value=\"%s\" />\n", xmlEscape(k), xmlEscape(logParams[k]))
+	}
+
+	fmt.Fprintf(buf, "    </rowset>\n  </result>\n  <cachedUntil></cachedUntil>\n</eveapi>\n")
+	return buf.Bytes()
+}
+
+func xmlEscape(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,75 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMockServesPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "char"), 0700)
+	fixture := `<eveapi version="2"><currentTime>2015-01-01 00:00:00</currentTime><result>skills</result><cachedUntil>2015-01-01 01:00:00</cachedUntil></eveapi>`
+	err = ioutil.WriteFile(filepath.Join(dir, "char", "skills.xml"), []byte(fixture), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMockServer(dir, nil)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	// Fixtures get fresh timestamps.
+	w := get("/char/Skills.xml.aspx?characterID=1")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "<result>skills</result>") || strings.Contains(w.Body.String(), "2015") {
+		t.Errorf("Fixture page got HTTP %d: %s", w.Code, w.Body.String())
+	}
+
+	// Pages without one echo the request.
+	w = get("/account/characters.xml.aspx?keyID=1")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `<row name="keyID" value="1" />`) {
+		t.Errorf("Generated page got HTTP %d: %s", w.Code, w.Body.String())
+	}
+
+	for url, code := range map[string]int{
+		"/char/locations.xml.aspx?ids=1,2,3&mockbadids=2": 400,
+		"/eve/alliancelist.xml.aspx?mockerror=418":        418,
+		"/nope.xml.aspx":                                  404,
+	} {
+		if w := get(url); w.Code != code {
+			t.Errorf("%s got HTTP %d, expected %d", url, w.Code, code)
+		}
+	}
+}
+
+func TestMockResponsesCapped(t *testing.T) {
+	m := NewMockServer("", nil)
+	m.maxResponses = 4
+
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/account/characters.xml.aspx?keyID=%d", i), nil))
+		if w.Code != 200 {
+			t.Fatalf("Request %d got HTTP %d", i, w.Code)
+		}
+	}
+
+	m.Lock()
+	count := len(m.responses)
+	m.Unlock()
+	if count > 4 {
+		t.Errorf("Mock remembers %d responses, expected at most 4", count)
+	}
+}
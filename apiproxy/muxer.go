@@ -0,0 +1,286 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+func makeParams(req *http.Request) map[string]string {
+	params := make(map[string]string)
+	for key, val := range req.Form {
+		params[key] = val[0]
+	}
+
+	return params
+}
+
+// Returns the address of the client, taking RealRemoteAddrHeader into account.
+func clientAddr(conf *Config, req *http.Request) string {
+	remoteAddr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteAddr = req.RemoteAddr
+	}
+	// Should we use a different header for our real address?
+	if conf.RealRemoteAddrHeader != "" && req.Header.Get(conf.RealRemoteAddrHeader) != "" {
+		if conf.ProxyAddr == "" || remoteAddr == conf.ProxyAddr {
+			remoteAddr = req.Header.Get(conf.RealRemoteAddrHeader)
+		}
+	}
+	return remoteAddr
+}
+
+// Checks an address against an IP or CIDR range.
+func addrMatches(addr, pattern string) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(addr)
+		return ip != nil && network.Contains(ip)
+	}
+	return addr == pattern
+}
+
+// Picks the priority class for a request from the priority header or the
+// client's address. Blank means the default class.
+func requestPriority(conf *Config, req *http.Request) string {
+	if conf.Priority.Header != "" {
+		if class := req.Header.Get(conf.Priority.Header); class != "" {
+			return class
+		}
+	}
+
+	remoteAddr := clientAddr(conf, req)
+	for _, c := range conf.Priority.Clients {
+		if addrMatches(remoteAddr, c.Addr) {
+			return c.Class
+		}
+	}
+	return ""
+}
+
+func (s *Server) logRequest(conf *Config, req *http.Request, url string, params map[string]string, resp *apicache.Response, result reqResult, startTime time.Time) {
+	remoteAddr := clientAddr(conf, req)
+
+	if strings.ToLower(conf.Logging.Format) == "json" {
+		if resp != nil || conf.Logging.LogRequests {
+			s.logRequestJSON(conf, remoteAddr, url, params, resp, result, startTime)
+		}
+		if resp == nil {
+			s.debugLog.Printf("%s - Invalid Request for %s%s", remoteAddr, url, formatLogParams(params, conf.Logging.CensorLog))
+		}
+		return
+	}
+
+	if resp == nil {
+		if conf.Logging.LogRequests && !conf.Logging.Debug {
+			s.log.Printf("%s - Invalid Request for %s", remoteAddr, url)
+		}
+		s.debugLog.Printf("%s - Invalid Request for %s%s", remoteAddr, url, formatLogParams(params, conf.Logging.CensorLog))
+		return
+	}
+
+	var errorStr string
+	if resp.Error.ErrorCode != 0 {
+		errorStr = fmt.Sprintf("Error %d: %s", resp.Error.ErrorCode, resp.Error.ErrorText)
+	}
+
+	s.log.Printf("%s - %s%s - http: %d - expires: %s - %.2f seconds - %s",
+		remoteAddr, url, formatLogParams(params, conf.Logging.CensorLog), resp.HTTPCode,
+		resp.Expires.Format("2006-01-02 15:04:05"), time.Since(startTime).Seconds(),
+		errorStr)
+}
+
+// Checks the Accept-Encoding header for an encoding the client hasn't
+// explicitly refused with q=0.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accept, ";")
+		if strings.ToLower(strings.TrimSpace(parts[0])) != encoding {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ServeHTTP is the muxer for the whole operation.  Everything starts here.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var resp *apicache.Response
+	var result reqResult
+	startTime := time.Now()
+	conf := s.getConf()
+
+	req.ParseForm()
+
+	url := path.Clean(req.URL.Path)
+	if url == "/stats" || url == "/stats.json" || url == "/metrics" {
+		if !statsAllowed(conf, req) {
+			s.log.Printf("%s - Unauthorized request for %s", clientAddr(conf, req), url)
+			http.Error(w, "Access token or control secret required.", 403)
+			return
+		}
+	}
+	if url == "/stats" {
+		s.statsHandler(w, req)
+		return
+	}
+	if url == "/stats.json" {
+		s.statsJSONHandler(w, req)
+		return
+	}
+	if url == "/metrics" {
+		s.metricsHandler(w, req)
+		return
+	}
+	if strings.HasPrefix(url, "/control/") {
+		s.controlHandler(w, req)
+		return
+	}
+
+	upstreamName, url, err := s.routeUpstream(conf, req, url)
+	if err != nil {
+		s.log.Printf("%s - Bad request for %s: %s", clientAddr(conf, req), url, err)
+		s.metrics.requests.Inc("invalid", "400")
+		w.Header().Add("Content-Type", "text/xml")
+		w.WriteHeader(400)
+		w.Write(apicache.SynthesizeAPIError(400, fmt.Sprintf("APIProxy Error: %s.", err), time.Minute))
+		return
+	}
+
+	params := makeParams(req)
+	params["upstream"] = upstreamName
+
+	token, authErr := authenticate(conf, req, url, params)
+	if authErr != nil {
+		s.log.Printf("%s - Unauthorized request for %s: %s", clientAddr(conf, req), url, authErr)
+		s.metrics.requests.Inc("unauthorized", strconv.Itoa(authErr.code))
+		w.Header().Add("Content-Type", "text/xml")
+		w.WriteHeader(authErr.code)
+		w.Write(apicache.SynthesizeAPIError(authErr.code, authErr.text, time.Minute))
+		return
+	}
+
+	// Authenticated clients are known by their token's name.
+	if token != nil {
+		params["client"] = token.Name
+	} else {
+		params["client"] = clientID(conf, req)
+	}
+	if _, ok := params["priority"]; !ok {
+		if class := requestPriority(conf, req); class != "" {
+			params["priority"] = class
+		}
+	}
+
+	s.debugLog.Printf("Starting request for %s...", url)
+
+	w.Header().Add("Content-Type", "text/xml")
+	if handler, valid := validPages[strings.ToLower(url)]; valid {
+		if handler == nil {
+			handler = (*Server).defaultHandler
+		}
+
+		fault := pickFaults(conf, req, url)
+		if fault.latency > 0 {
+			s.metrics.faults.Inc("latency")
+			time.Sleep(fault.latency)
+		}
+		if fault.reset {
+			s.metrics.faults.Inc("reset")
+			s.debugLog.Printf("Injecting connection reset for %s", url)
+			resetConnection(w)
+			return
+		}
+		if fault.errorCode != 0 {
+			s.metrics.faults.Inc("error")
+			resp = faultResponse(fault.errorCode)
+		} else {
+			resp, result = handler(s, url, params)
+		}
+
+		if isStale(resp) {
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+		}
+
+		body := resp.Data
+		if ec, ok := s.cache.(EncodedCache); ok {
+			w.Header().Add("Vary", "Accept-Encoding")
+			// Cutting a gzip stream short would corrupt it rather than leave
+			// the client with a truncated page.
+			if acceptsEncoding(req, "gzip") && !fault.truncate {
+				gz, err := ec.GetEncoded(requestTag(url, params), "gzip", resp.Expires)
+				if err == nil {
+					w.Header().Set("Content-Encoding", "gzip")
+					body = gz
+				}
+			}
+		}
+
+		if fault.truncate {
+			s.metrics.faults.Inc("truncate")
+			body = body[:len(body)/2]
+		}
+
+		w.WriteHeader(resp.HTTPCode)
+		w.Write(body)
+		s.metrics.requests.Inc(strings.ToLower(url), strconv.Itoa(resp.HTTPCode))
+		if resp.Error.ErrorCode != 0 {
+			s.metrics.apiErrors.Inc(strconv.Itoa(resp.Error.ErrorCode))
+		}
+	} else {
+		s.metrics.requests.Inc("invalid", "404")
+		w.WriteHeader(404)
+		w.Write(apicache.SynthesizeAPIError(404, "Invalid API page.", 24*time.Hour))
+	}
+
+	if conf.Logging.LogRequests || (resp != nil && resp.HTTPCode != 200) {
+		s.logRequest(conf, req, url, params, resp, result, startTime)
+	}
+
+	if conf.Logging.Debug && time.Since(startTime).Seconds() > 10 {
+		s.debugLog.Printf("Slow Request took %.2f seconds: %s - %s%s", time.Since(startTime).Seconds(),
+			clientAddr(conf, req), url, formatLogParams(params, conf.Logging.CensorLog))
+	}
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	s.LogStats(w)
+}
+
+func (s *Server) LogStats(w io.Writer) {
+	s.PrintWorkerStats(w)
+	fmt.Fprintln(w, "")
+	s.PrintStaleStats(w)
+	fmt.Fprintln(w, "")
+	s.PrintClientStats(w)
+	fmt.Fprintln(w, "")
+	s.PrintUpstreamStats(w)
+	fmt.Fprintln(w, "")
+	s.cache.LogStats(w)
+	fmt.Fprintln(w, "")
+	s.warmer.LogStats(w)
+	fmt.Fprintln(w, "")
+	LogMemStats(w)
+}
+
+func LogMemStats(w io.Writer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(w, "Alloc: %dkb Sys: %dkb\n", m.Alloc/1024, m.Sys/1024)
+	fmt.Fprintf(w, "HeapAlloc: %dkb HeapSys: %dkb\n", m.HeapAlloc/1024, m.HeapSys/1024)
+}
@@ -0,0 +1,247 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+// How long to wait before trying again after a failed refresh.
+const prewarmRetryDelay = time.Minute
+
+// A request kept fresh in the cache by the prewarmer.
+type warmKey struct {
+	url    string
+	params map[string]string
+
+	expires       time.Time
+	lastRequested time.Time
+	configured    bool
+	refreshing    bool
+}
+
+// Counts requests for keys that aren't hot yet.
+type warmCandidate struct {
+	count int
+	start time.Time
+}
+
+type prewarmer struct {
+	server *Server
+
+	keys       map[string]*warmKey
+	candidates map[string]*warmCandidate
+
+	refreshes, failures int
+
+	sync.Mutex
+}
+
+func newPrewarmer(s *Server) *prewarmer {
+	return &prewarmer{
+		server:     s,
+		keys:       make(map[string]*warmKey),
+		candidates: make(map[string]*warmCandidate),
+	}
+}
+
+// Parses a configured key of the form /path?param=value&...
+func parseWarmKey(key string) (string, map[string]string, error) {
+	u, err := neturl.Parse(strings.TrimSpace(key))
+	if err != nil {
+		return "", nil, err
+	}
+
+	url := path.Clean(u.Path)
+	if _, valid := validPages[strings.ToLower(url)]; !valid {
+		return "", nil, fmt.Errorf("Invalid API page %s", url)
+	}
+
+	params := make(map[string]string)
+	for k, v := range u.Query() {
+		params[k] = v[0]
+	}
+	return url, params, nil
+}
+
+// Records a live request, promoting it to a hot key once it has been seen
+// often enough. Hot keys that stop being requested are dropped by run.
+func (p *prewarmer) track(url string, params map[string]string, resp *apicache.Response) {
+	if resp == nil || resp.HTTPCode != 200 || resp.Error.ErrorCode != 0 {
+		return
+	}
+
+	conf := p.server.getConf()
+	tag := requestTag(url, params)
+	now := time.Now()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if k, ok := p.keys[tag]; ok {
+		k.lastRequested = now
+		if resp.Expires.After(k.expires) {
+			k.expires = resp.Expires
+		}
+		return
+	}
+
+	if conf.Prewarm.HotRequests <= 0 || len(p.keys) >= conf.Prewarm.MaxHotKeys {
+		return
+	}
+
+	hotPeriod := time.Duration(conf.Prewarm.HotPeriod) * time.Second
+	c, ok := p.candidates[tag]
+	if !ok || now.Sub(c.start) > hotPeriod {
+		// Don't let one off requests pile up forever.
+		if len(p.candidates) >= conf.Prewarm.MaxHotKeys*10 {
+			p.candidates = make(map[string]*warmCandidate)
+		}
+		c = &warmCandidate{start: now}
+		p.candidates[tag] = c
+	}
+	c.count++
+
+	if c.count >= conf.Prewarm.HotRequests {
+		delete(p.candidates, tag)
+
+		keyParams := make(map[string]string)
+		for k, v := range params {
+			if !proxyParams[k] || k == "upstream" {
+				keyParams[k] = v
+			}
+		}
+		p.keys[tag] = &warmKey{
+			url:           url,
+			params:        keyParams,
+			expires:       resp.Expires,
+			lastRequested: now,
+		}
+		p.server.debugLog.Printf("Prewarming hot key %s", url)
+	}
+}
+
+// Refetches a key through the background queue.
+func (p *prewarmer) refresh(tag string, k *warmKey) {
+	s := p.server
+	apireq := s.newAPIRequest(k.url, k.params)
+	apireq.Force = true
+
+	resp, info, err := s.coalesce(tag, func() (*apicache.Response, fetchInfo, error) {
+		return s.fetchAPI(apireq, s.newAPICall(k.url, k.params), s.workQueue.class(backgroundClass))
+	})
+
+	p.Lock()
+	defer p.Unlock()
+
+	k.refreshing = false
+	p.refreshes++
+	if upstreamFailed(resp, err) || resp.Error.ErrorCode != 0 {
+		s.debugLog.Printf("w%s: Prewarm refresh of %s failed: %v", info.workerID, k.url, err)
+		p.failures++
+		k.expires = time.Now().Add(prewarmRetryDelay)
+		return
+	}
+	k.expires = resp.Expires
+}
+
+// Periodically refreshes keys that have expired, until the server shuts down.
+func (p *prewarmer) run() {
+	conf := p.server.getConf()
+	delay := time.Duration(conf.Prewarm.RefreshDelay) * time.Second
+	hotPeriod := time.Duration(conf.Prewarm.HotPeriod) * time.Second
+
+	for {
+		now := time.Now()
+
+		p.Lock()
+		for tag, k := range p.keys {
+			if !k.configured && now.Sub(k.lastRequested) > hotPeriod {
+				p.server.debugLog.Printf("Key %s no longer hot.", k.url)
+				delete(p.keys, tag)
+				continue
+			}
+			if !k.refreshing && now.After(k.expires.Add(delay)) {
+				k.refreshing = true
+				go p.refresh(tag, k)
+			}
+		}
+		p.Unlock()
+
+		select {
+		case <-p.server.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+type prewarmStat struct {
+	Keys       int
+	Configured int
+	Refreshes  int
+	Failures   int
+}
+
+func (p *prewarmer) Stats() prewarmStat {
+	p.Lock()
+	defer p.Unlock()
+
+	stat := prewarmStat{Keys: len(p.keys), Refreshes: p.refreshes, Failures: p.failures}
+	for _, k := range p.keys {
+		if k.configured {
+			stat.Configured++
+		}
+	}
+	return stat
+}
+
+func (p *prewarmer) LogStats(w io.Writer) {
+	p.Lock()
+	defer p.Unlock()
+
+	configured := 0
+	for _, k := range p.keys {
+		if k.configured {
+			configured++
+		}
+	}
+
+	fmt.Fprintf(w, "Prewarming %d keys (%d configured, %d hot). %d refreshes, %d failed.\n",
+		len(p.keys), configured, len(p.keys)-configured, p.refreshes, p.failures)
+}
+
+// Loads the configured keys and starts refreshing. Configured keys are
+// fetched right away.
+func (p *prewarmer) start() {
+	conf := p.server.getConf()
+
+	p.Lock()
+	for _, key := range conf.Prewarm.Keys {
+		url, params, err := parseWarmKey(key)
+		if err != nil {
+			p.server.log.Printf("Ignoring prewarm key %s: %s", key, err)
+			continue
+		}
+		p.keys[requestTag(url, params)] = &warmKey{
+			url:        url,
+			params:     params,
+			configured: true,
+		}
+	}
+	count := len(p.keys)
+	p.Unlock()
+
+	if count == 0 && conf.Prewarm.HotRequests <= 0 {
+		return
+	}
+
+	p.server.log.Printf("Prewarming %d configured keys.", count)
+	go p.run()
+}
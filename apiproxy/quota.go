@@ -0,0 +1,167 @@
+package apiproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/inominate/apicache"
+	"github.com/inominate/ratelimit"
+)
+
+// Clients idle for this long are forgotten.
+const clientIdleTimeout = 30 * time.Minute
+
+// A client's share of the global request and error limits.
+type clientLimits struct {
+	rateLimiter      *ratelimit.RateLimit
+	errorRateLimiter *ratelimit.RateLimit
+
+	lastSeen time.Time
+
+	requests, errors, rejected int64
+}
+
+// Identifies the client making a request, by the identity header if
+// configured and present, otherwise by address.
+func clientID(conf *Config, req *http.Request) string {
+	if conf.Quota.IdentityHeader != "" {
+		if id := req.Header.Get(conf.Quota.IdentityHeader); id != "" {
+			return id
+		}
+	}
+	return clientAddr(conf, req)
+}
+
+// Returns the limits for a client, nil if it has none.
+func (s *Server) getClientLimits(conf *Config, id string) *clientLimits {
+	if id == "" {
+		return nil
+	}
+
+	rps := conf.Quota.RequestsPerSecond
+	maxErrors := conf.Quota.MaxErrors
+	for _, c := range conf.Quota.Clients {
+		if c.ID == id {
+			rps = c.RequestsPerSecond
+			maxErrors = c.MaxErrors
+			break
+		}
+	}
+	if rps <= 0 && maxErrors <= 0 {
+		return nil
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	cl, ok := s.clients[id]
+	if !ok {
+		cl = &clientLimits{}
+		if rps > 0 {
+			cl.rateLimiter = ratelimit.NewRateLimit(rps, time.Second)
+		}
+		if maxErrors > 0 {
+			cl.errorRateLimiter = ratelimit.NewRateLimit(maxErrors, time.Duration(conf.ErrorPeriod)*time.Second)
+		}
+		s.clients[id] = cl
+	}
+	cl.lastSeen = time.Now()
+	return cl
+}
+
+// Returned along with quotaError's response by a fetch refused for being over
+// its client's share. Requests coalesced onto it aren't refused with it.
+var errOverQuota = errors.New("Client over quota")
+
+// Builds the response given to a client that has used up its share.
+func quotaError(what string) *apicache.Response {
+	errStr := fmt.Sprintf("APIProxy Error: Client %s quota exceeded.", what)
+	return &apicache.Response{
+		Data:     apicache.SynthesizeAPIError(429, errStr, time.Minute),
+		Expires:  time.Now().Add(time.Minute),
+		Error:    apicache.APIError{ErrorCode: 429, ErrorText: errStr},
+		HTTPCode: 429,
+	}
+}
+
+// Waits up to timeout for room in the client's allowances before it may go to
+// the API. Returns a synthesized error response if the client is over its
+// share.
+func (cl *clientLimits) start(timeout time.Duration) *apicache.Response {
+	var eErr, rErr error
+	if cl.errorRateLimiter != nil {
+		eErr = cl.errorRateLimiter.Start(timeout)
+	}
+	if eErr == nil && cl.rateLimiter != nil {
+		rErr = cl.rateLimiter.Start(timeout)
+		if rErr != nil && cl.errorRateLimiter != nil {
+			cl.errorRateLimiter.Finish(true)
+		}
+	}
+
+	if eErr != nil {
+		atomic.AddInt64(&cl.rejected, 1)
+		return quotaError("error")
+	}
+	if rErr != nil {
+		atomic.AddInt64(&cl.rejected, 1)
+		return quotaError("request")
+	}
+	atomic.AddInt64(&cl.requests, 1)
+	return nil
+}
+
+// Records the outcome of a request allowed by start.
+func (cl *clientLimits) finish(resp *apicache.Response) {
+	failed := resp == nil || resp.Error.ErrorCode != 0
+	if failed {
+		atomic.AddInt64(&cl.errors, 1)
+	}
+
+	if cl.errorRateLimiter != nil {
+		cl.errorRateLimiter.Finish(!failed)
+	}
+	if cl.rateLimiter != nil {
+		cl.rateLimiter.Finish(false)
+	}
+}
+
+func (s *Server) clientPurger() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(10 * time.Minute):
+		}
+
+		s.clientsLock.Lock()
+		for id, cl := range s.clients {
+			if time.Since(cl.lastSeen) > clientIdleTimeout {
+				delete(s.clients, id)
+			}
+		}
+		s.clientsLock.Unlock()
+	}
+}
+
+func (s *Server) PrintClientStats(w io.Writer) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		cl := s.clients[id]
+		fmt.Fprintf(w, "Client %s: %d requests, %d errors, %d over quota.\n", id,
+			atomic.LoadInt64(&cl.requests), atomic.LoadInt64(&cl.errors), atomic.LoadInt64(&cl.rejected))
+	}
+}
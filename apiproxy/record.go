@@ -0,0 +1,182 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache records are a header followed by the body, all integers are big
+// endian.
+//
+//	magic    [4]byte "EAPC"
+//	version  uint8
+//	encoding uint8, compression applied to the body (version 2 and up)
+//	HTTPCode uint16
+//	Expires  int64, unix nanoseconds
+//	checksum uint32, CRC-32 (IEEE) of the body as stored
+//	length   uint32, length of the body as stored
+//	keylen   uint16, length of the key (version 3 and up)
+//	key      [keylen]byte, the request the entry answers, see cacheKey
+const recordMagic = "EAPC"
+const recordVersion = 3
+
+// Sizes of the fixed part of the header for each record version.
+var recordHeaderSizes = map[byte]int{
+	1: 4 + 1 + 2 + 8 + 4 + 4,
+	2: 4 + 1 + 1 + 2 + 8 + 4 + 4,
+	3: 4 + 1 + 1 + 2 + 8 + 4 + 4 + 2,
+}
+var recordHeaderSize = recordHeaderSizes[recordVersion]
+
+// Keys longer than this are left out of the record.
+const maxRecordKey = 0xffff
+
+type recordHeader struct {
+	Encoding byte
+	HTTPCode int
+	Expires  time.Time
+	Checksum uint32
+	Length   int
+	Key      string
+	// Including the key.
+	HeaderSize int
+}
+
+func packRecord(HTTPCode int, Expires time.Time, encoding byte, key string, data []byte) []byte {
+	if len(key) > maxRecordKey {
+		key = ""
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, recordHeaderSize+len(key)+len(data)))
+
+	buf.WriteString(recordMagic)
+	buf.WriteByte(recordVersion)
+	buf.WriteByte(encoding)
+	binary.Write(buf, binary.BigEndian, uint16(HTTPCode))
+	binary.Write(buf, binary.BigEndian, Expires.UnixNano())
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(data))
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+	buf.WriteString(key)
+	buf.Write(data)
+
+	return buf.Bytes()
+}
+
+// Reads and validates just the header of a record.
+func readRecordHeader(r io.Reader) (recordHeader, error) {
+	var rh recordHeader
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return rh, fmt.Errorf("Short record header: %s", err)
+	}
+
+	if string(header[0:4]) != recordMagic {
+		return rh, fmt.Errorf("Not a cache record.")
+	}
+	version := header[4]
+	rh.HeaderSize = recordHeaderSizes[version]
+	if rh.HeaderSize == 0 {
+		return rh, fmt.Errorf("Unknown cache record version %d.", version)
+	}
+
+	header = make([]byte, rh.HeaderSize-5)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return rh, fmt.Errorf("Short record header: %s", err)
+	}
+
+	// Version 1 records have no encoding and are always uncompressed.
+	if version >= 2 {
+		rh.Encoding = header[0]
+		header = header[1:]
+	}
+
+	rh.HTTPCode = int(binary.BigEndian.Uint16(header[0:2]))
+	rh.Expires = time.Unix(0, int64(binary.BigEndian.Uint64(header[2:10])))
+	rh.Checksum = binary.BigEndian.Uint32(header[10:14])
+	rh.Length = int(binary.BigEndian.Uint32(header[14:18]))
+
+	if version >= 3 {
+		key := make([]byte, binary.BigEndian.Uint16(header[18:20]))
+		_, err = io.ReadFull(r, key)
+		if err != nil {
+			return rh, fmt.Errorf("Short record key: %s", err)
+		}
+		rh.Key = string(key)
+		rh.HeaderSize += len(key)
+	}
+
+	return rh, nil
+}
+
+// Splits a complete record into its header and body, verifying the body
+// against the stored length and checksum. The body is returned as stored.
+func unpackRecord(record []byte) (recordHeader, []byte, error) {
+	rh, err := readRecordHeader(bytes.NewReader(record))
+	if err != nil {
+		return rh, nil, err
+	}
+
+	data := record[rh.HeaderSize:]
+	if len(data) != rh.Length {
+		return rh, nil, fmt.Errorf("Record length mismatch (Got: %d Expected: %d)", len(data), rh.Length)
+	}
+	if crc32.ChecksumIEEE(data) != rh.Checksum {
+		return rh, nil, fmt.Errorf("Record checksum mismatch.")
+	}
+
+	return rh, data, nil
+}
+
+// Temporary files are created alongside their destination with this in the
+// name so that leftovers from a crash can be recognized.
+const tempFileMarker = ".tmp"
+
+// Writes data to a temporary file and renames it over filename, so readers
+// only ever see the old or the new contents.
+func writeFileAtomic(filename string, data []byte) error {
+	temp, err := writeTempFile(filename, data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp, filename)
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+// Writes data to a temporary file alongside filename, ready to be renamed
+// over it, and returns its name.
+func writeTempFile(filename string, data []byte) (string, error) {
+	fp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+tempFileMarker)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(fp.Name(), 0660)
+	}
+
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", err
+	}
+	return fp.Name(), nil
+}
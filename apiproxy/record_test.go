@@ -0,0 +1,141 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnpackRecord(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	body := []byte("<eveapi>body</eveapi>")
+	record := packRecord(200, expires, encodingNone, "/eve/CharacterName.xml.aspx?ids=1", body)
+
+	rh, data, err := unpackRecord(record)
+	if err != nil || rh.HTTPCode != 200 || !rh.Expires.Equal(expires) || rh.Key != "/eve/CharacterName.xml.aspx?ids=1" || !bytes.Equal(data, body) {
+		t.Fatalf("Got %+v %q %v", rh, data, err)
+	}
+
+	corrupt := func(change func(r []byte) []byte) []byte {
+		r := append([]byte(nil), record...)
+		return change(r)
+	}
+	for name, bad := range map[string][]byte{
+		"flipped body byte": corrupt(func(r []byte) []byte { r[len(r)-1] ^= 1; return r }),
+		"truncated body":    corrupt(func(r []byte) []byte { return r[:len(r)-1] }),
+		"truncated header":  corrupt(func(r []byte) []byte { return r[:10] }),
+		"bad magic":         corrupt(func(r []byte) []byte { r[0] = 'X'; return r }),
+		"unknown version":   corrupt(func(r []byte) []byte { r[4] = 99; return r }),
+	} {
+		if _, _, err := unpackRecord(bad); err == nil {
+			t.Errorf("Record with %s accepted", name)
+		}
+	}
+}
+
+// Records written before encodings and keys were added are still readable.
+func TestUnpackVersion1Record(t *testing.T) {
+	expires := time.Unix(1500000000, 0)
+	body := []byte("<eveapi>old</eveapi>")
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(recordMagic)
+	buf.WriteByte(1)
+	binary.Write(buf, binary.BigEndian, uint16(200))
+	binary.Write(buf, binary.BigEndian, expires.UnixNano())
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(body))
+	binary.Write(buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+
+	rh, data, err := unpackRecord(buf.Bytes())
+	if err != nil || rh.HTTPCode != 200 || !rh.Expires.Equal(expires) || rh.Encoding != encodingNone || !bytes.Equal(data, body) {
+		t.Errorf("Got %+v %q %v", rh, data, err)
+	}
+}
+
+func TestDiskCacheMigratesLegacyEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	write := func(name string, data []byte) {
+		filename := filepath.Join(dir, name[:1], name)
+		os.MkdirAll(filepath.Dir(filename), 0770)
+		err := ioutil.WriteFile(filename, data, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy := func(tag string, expires time.Time, body string) {
+		meta, _ := json.Marshal(CacheEntry{HTTPCode: 200, Expires: expires})
+		write(tag, meta)
+		write(tag+".xml", []byte(body))
+	}
+
+	legacy("0current", expires, "current")
+	legacy("1expired", time.Now().Add(-time.Hour), "expired")
+	write("2orphan.xml", []byte("no metadata"))
+	write("3nodata", []byte(`{"HTTPCode": 200}`))
+	write("4interrupted"+tempFileMarker+"123", []byte("partial"))
+
+	dc, err := NewDiskCache(dir, false, CacheLimits{}, encodingNone, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+
+	code, data, exp, err := dc.Get("0current")
+	if err != nil || code != 200 || string(data) != "current" || !exp.Equal(expires) {
+		t.Errorf("Migrated entry got %d %q %s %v", code, data, exp, err)
+	}
+	record, err := ioutil.ReadFile(filepath.Join(dir, "0", "0current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := unpackRecord(record); err != nil {
+		t.Errorf("Entry not migrated to a packed record: %s", err)
+	}
+
+	for _, name := range []string{"0current.xml", "1expired", "1expired.xml", "2orphan.xml", "3nodata", "4interrupted" + tempFileMarker + "123"} {
+		if _, err := os.Stat(filepath.Join(dir, name[:1], name)); err == nil {
+			t.Errorf("%s left behind", name)
+		}
+	}
+}
+
+func TestDiskCacheRejectsCorruptEntry(t *testing.T) {
+	dc, cleanup := newTestDiskCache(t, CacheLimits{})
+	defer cleanup()
+
+	dc.Store("0tag", 200, []byte("<eveapi>body</eveapi>"), time.Now().Add(time.Hour))
+
+	filename := dc.filename("0tag")
+	record, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record[len(record)-1] ^= 1
+	err = ioutil.WriteFile(filename, record, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, data, _, err := dc.Get("0tag"); err == nil {
+		t.Errorf("Corrupt entry served: %q", data)
+	}
+	if _, err := os.Stat(filename); err == nil {
+		t.Errorf("Corrupt entry not removed")
+	}
+	if _, _, _, err := dc.Get("0tag"); err == nil {
+		t.Errorf("Corrupt entry still cached")
+	}
+}
@@ -0,0 +1,385 @@
+package apiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long any single redis command may take before we give up on the
+// connection.
+const redisTimeout = 5 * time.Second
+
+// Maximum number of idle connections kept around for reuse.
+const redisIdleConns = 16
+
+// Bytes fetched at a time when reading just a record's header, enough for the
+// header and most keys in one go.
+const redisHeaderRead = 1024
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis Error: " + string(e)
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Sends a single command and reads back its reply. Replies are returned as
+// string for status replies, int64 for integers, []byte for bulk strings,
+// nil for null bulk strings and []interface{} for arrays. Error replies are
+// returned as a redisError.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("Redis protocol error: bad line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(c.r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			replies[i], err = c.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("Redis protocol error: unknown reply %q", line)
+}
+
+// RedisCache stores cache entries in any server speaking the redis protocol,
+// allowing several proxies to share one cache. Entries are given a TTL
+// matching their expiration plus retention so the server handles the cleanup.
+type RedisCache struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	retain   time.Duration
+
+	idle chan *redisConn
+
+	log      *log.Logger
+	debugLog *log.Logger
+
+	hits, misses, errors int64
+}
+
+func (r *RedisCache) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn, bufio.NewReader(conn)}
+
+	if r.password != "" {
+		_, err = rc.do("AUTH", r.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		_, err = rc.do("SELECT", strconv.Itoa(r.db))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Runs a command on a pooled connection. Connections that fail for anything
+// other than an error reply are discarded.
+func (r *RedisCache) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	var err error
+
+	select {
+	case rc = <-r.idle:
+	default:
+		rc, err = r.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case r.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (r *RedisCache) Store(cacheTag string, HTTPCode int, data []byte, Expires time.Time) error {
+	return r.StoreKeyed(cacheTag, "", HTTPCode, data, Expires)
+}
+
+func (r *RedisCache) StoreKeyed(cacheTag string, key string, HTTPCode int, data []byte, Expires time.Time) error {
+	ttl := Expires.Add(r.retain).Sub(time.Now()) / time.Millisecond
+	if ttl <= 0 {
+		return nil
+	}
+
+	record := packRecord(HTTPCode, Expires, encodingNone, key, data)
+	_, err := r.do("SET", r.prefix+cacheTag, string(record), "PX", strconv.FormatInt(int64(ttl), 10))
+	if err != nil {
+		atomic.AddInt64(&r.errors, 1)
+		r.debugLog.Printf("Redis Store Error: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (r *RedisCache) Get(cacheTag string) (int, []byte, time.Time, error) {
+	reply, err := r.do("GET", r.prefix+cacheTag)
+	if err != nil {
+		atomic.AddInt64(&r.errors, 1)
+		r.debugLog.Printf("Redis Get Error: %s", err)
+		return 0, nil, time.Time{}, err
+	}
+
+	value, ok := reply.([]byte)
+	if !ok {
+		atomic.AddInt64(&r.misses, 1)
+		return 0, nil, time.Time{}, fmt.Errorf("Not cached.")
+	}
+
+	rh, data, err := unpackRecord(value)
+	if err == nil {
+		data, err = decompressBody(rh.Encoding, data)
+	}
+	if err != nil {
+		atomic.AddInt64(&r.errors, 1)
+		r.log.Printf("Cache consistency error: %s", err)
+		return 0, nil, time.Time{}, fmt.Errorf("Cache error - cache invalid.")
+	}
+
+	if time.Now().After(rh.Expires.Add(r.retain)) {
+		atomic.AddInt64(&r.misses, 1)
+		return 0, nil, rh.Expires, fmt.Errorf("Not cached.")
+	}
+
+	atomic.AddInt64(&r.hits, 1)
+	return rh.HTTPCode, data, rh.Expires, nil
+}
+
+// Escapes glob characters for use in a SCAN pattern.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (r *RedisCache) Purge(cacheTag string) (int, error) {
+	reply, err := r.do("DEL", r.prefix+cacheTag)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := reply.(int64)
+	return int(count), nil
+}
+
+// Reads a stored value a range at a time with GETRANGE.
+type redisRangeReader struct {
+	r      *RedisCache
+	name   string
+	offset int
+	// The first redis error, as opposed to a short or missing value.
+	err error
+}
+
+func (rr *redisRangeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	reply, err := rr.r.do("GETRANGE", rr.name, strconv.Itoa(rr.offset), strconv.Itoa(rr.offset+len(p)-1))
+	if err != nil {
+		rr.err = err
+		return 0, err
+	}
+	data, _ := reply.([]byte)
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, data)
+	rr.offset += n
+	return n, nil
+}
+
+// Reads the header of a stored record without fetching its body. Records we
+// can't make sense of, or that have gone, have no key. Only failures talking
+// to redis are returned.
+func (r *RedisCache) getRecordHeader(name string) (recordHeader, error) {
+	rr := &redisRangeReader{r: r, name: name}
+	rh, _ := readRecordHeader(bufio.NewReaderSize(rr, redisHeaderRead))
+	return rh, rr.err
+}
+
+// Goes through every entry under our prefix, reading the key stored in each
+// record and deleting those match accepts.
+func (r *RedisCache) PurgeMatching(match func(key string) bool) (int, error) {
+	pattern := redisGlobEscaper.Replace(r.prefix) + "*"
+	cursor := "0"
+	count := 0
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return count, err
+		}
+
+		scan, ok := reply.([]interface{})
+		if !ok || len(scan) != 2 {
+			return count, fmt.Errorf("Redis protocol error: unexpected SCAN reply")
+		}
+		next, _ := scan[0].([]byte)
+		keys, _ := scan[1].([]interface{})
+
+		args := []string{"DEL"}
+		for _, key := range keys {
+			k, ok := key.([]byte)
+			if !ok {
+				continue
+			}
+			rh, err := r.getRecordHeader(string(k))
+			if err != nil {
+				return count, err
+			}
+			if match(rh.Key) {
+				args = append(args, string(k))
+			}
+		}
+
+		if len(args) > 1 {
+			reply, err = r.do(args...)
+			if err != nil {
+				return count, err
+			}
+			deleted, _ := reply.(int64)
+			count += int(deleted)
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return count, nil
+		}
+	}
+}
+
+// Closes the idle connections, commands still running finish on their own.
+func (r *RedisCache) Close() error {
+	for {
+		select {
+		case rc := <-r.idle:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (r *RedisCache) LogStats(w io.Writer) {
+	fmt.Fprintf(w, "Redis Cache: %s  Hits: %d  Misses: %d  Errors: %d\n", r.addr,
+		atomic.LoadInt64(&r.hits), atomic.LoadInt64(&r.misses), atomic.LoadInt64(&r.errors))
+
+	// Counting just our own keys would mean scanning them all.
+	reply, err := r.do("DBSIZE")
+	if err != nil {
+		fmt.Fprintf(w, "Redis Keys in database %d: unknown (%s)\n", r.db, err)
+		return
+	}
+	fmt.Fprintf(w, "Redis Keys in database %d, including any not under prefix %q: %d\n", r.db, r.prefix, reply)
+}
+
+// Creates a redis backed cache, checking that the server can be reached.
+func NewRedisCache(addr, password string, db int, prefix string, retain time.Duration, logger, debugLog *log.Logger) (*RedisCache, error) {
+	var rc RedisCache
+
+	rc.addr = addr
+	rc.password = password
+	rc.db = db
+	rc.prefix = prefix
+	rc.retain = retain
+	rc.idle = make(chan *redisConn, redisIdleConns)
+	rc.log = orDiscard(logger)
+	rc.debugLog = orDiscard(debugLog)
+
+	reply, err := rc.do("PING")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to redis at %s: %s", addr, err)
+	}
+	if reply != "PONG" {
+		return nil, fmt.Errorf("Unexpected reply from redis at %s: %v", addr, reply)
+	}
+
+	return &rc, nil
+}
@@ -0,0 +1,303 @@
+package apiproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Speaks just enough of the redis protocol for RedisCache.
+type fakeRedis struct {
+	listener net.Listener
+
+	values   map[string]string
+	expires  map[string]time.Time
+	commands []string
+	sync.Mutex
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: l,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) Close() error {
+	return f.listener.Close()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeRedis) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		reply := f.run(args)
+		f.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// Runs a command with the lock held and returns the encoded reply.
+func (f *fakeRedis) run(args []string) string {
+	for k, e := range f.expires {
+		if time.Now().After(e) {
+			delete(f.values, k)
+			delete(f.expires, k)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		f.values[args[1]] = args[2]
+		delete(f.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "GETRANGE":
+		v := f.values[args[1]]
+		start, _ := strconv.Atoi(args[2])
+		end, _ := strconv.Atoi(args[3])
+		if end >= len(v) {
+			end = len(v) - 1
+		}
+		if start > end {
+			return bulk("")
+		}
+		return bulk(v[start : end+1])
+	case "DEL":
+		count := 0
+		for _, k := range args[1:] {
+			if _, ok := f.values[k]; ok {
+				delete(f.values, k)
+				delete(f.expires, k)
+				count++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", count)
+	case "SCAN":
+		// Everything in one go, redis globs escape like path.Match.
+		var keys []string
+		for k := range f.values {
+			if ok, _ := path.Match(args[3], k); ok {
+				keys = append(keys, bulk(k))
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	case "DBSIZE":
+		return fmt.Sprintf(":%d\r\n", len(f.values))
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisCacheStoreGet(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	rc, err := NewRedisCache(server.addr(), "password", 2, "apiproxy:", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	body := []byte("<eveapi>\r\n\x00binary</eveapi>")
+	err = rc.Store("tag", 200, body, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, data, exp, err := rc.Get("tag")
+	if err != nil || code != 200 || string(data) != string(body) || !exp.Equal(expires) {
+		t.Errorf("Got %d %q %s %v, expected 200 %q %s", code, data, exp, err, body, expires)
+	}
+	if _, _, _, err := rc.Get("missing"); err == nil {
+		t.Errorf("Missing entry found")
+	}
+
+	server.Lock()
+	_, prefixed := server.values["apiproxy:tag"]
+	commands := server.commands
+	server.Unlock()
+	if !prefixed {
+		t.Errorf("Entry not stored under the prefix")
+	}
+	if len(commands) < 2 || commands[0] != "AUTH password" || commands[1] != "SELECT 2" {
+		t.Errorf("Connection not set up with AUTH and SELECT: %q", commands)
+	}
+}
+
+func TestRedisCacheExpiry(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	retain := 400 * time.Millisecond
+	rc, err := NewRedisCache(server.addr(), "", 0, "apiproxy:", retain, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// Long gone entries aren't stored at all.
+	rc.Store("old", 200, []byte("old"), time.Now().Add(-time.Hour))
+	if _, _, _, err := rc.Get("old"); err == nil {
+		t.Errorf("Expired entry stored")
+	}
+
+	// Expired entries are kept for the retention period, then left to redis.
+	expires := time.Now().Add(200 * time.Millisecond)
+	rc.Store("soon", 200, []byte("soon"), expires)
+	time.Sleep(300 * time.Millisecond)
+	if _, data, _, err := rc.Get("soon"); err != nil || string(data) != "soon" {
+		t.Errorf("Entry within retention lost: %q %v", data, err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if _, _, _, err := rc.Get("soon"); err == nil {
+		t.Errorf("Entry still served after retention")
+	}
+}
+
+func TestRedisCachePurge(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	rc, err := NewRedisCache(server.addr(), "", 0, "a*:", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	expires := time.Now().Add(time.Hour)
+	rc.StoreKeyed("1", "/char/SkillQueue.xml.aspx?characterID=1", 200, []byte("1"), expires)
+	rc.StoreKeyed("2", "/char/SkillQueue.xml.aspx?characterID=2", 200, []byte("2"), expires)
+	rc.StoreKeyed("3", "/eve/CharacterName.xml.aspx?ids=1", 200, []byte("3"), expires)
+	rc.Store("4", 200, []byte("4"), expires)
+	// Keys longer than the first read of the header.
+	longKey := "/char/SkillQueue.xml.aspx?characterID=1&padding=" + strings.Repeat("x", 2*redisHeaderRead)
+	rc.StoreKeyed("5", longKey, 200, []byte(strings.Repeat("5", 10000)), expires)
+	// Another proxy's entry, whose prefix our glob must not match.
+	server.Lock()
+	server.values["ab:5"] = string(packRecord(200, expires, encodingNone, "/char/SkillQueue.xml.aspx?characterID=1", []byte("5")))
+	server.Unlock()
+
+	count, err := rc.Purge("4")
+	if err != nil || count != 1 {
+		t.Errorf("Purge removed %d entries: %v", count, err)
+	}
+	server.Lock()
+	server.commands = nil
+	server.Unlock()
+	count, err = rc.PurgeMatching(keyMatcher("/char/skillqueue.xml.aspx", map[string]string{"characterid": "1"}))
+	if err != nil || count != 2 {
+		t.Errorf("PurgeMatching removed %d entries: %v", count, err)
+	}
+	server.Lock()
+	for _, c := range server.commands {
+		if strings.HasPrefix(c, "GET ") {
+			t.Errorf("PurgeMatching fetched a whole entry: %.40s", c)
+		}
+	}
+	server.Unlock()
+
+	for tag, kept := range map[string]bool{"1": false, "2": true, "3": true, "4": false, "5": false} {
+		_, _, _, err := rc.Get(tag)
+		if kept != (err == nil) {
+			t.Errorf("Entry %s kept %t, expected %t", tag, err == nil, kept)
+		}
+	}
+	server.Lock()
+	_, ok := server.values["ab:5"]
+	server.Unlock()
+	if !ok {
+		t.Errorf("Entry under another prefix purged")
+	}
+}
+
+func TestRedisCacheUnreachable(t *testing.T) {
+	server := newFakeRedis(t)
+	server.Close()
+
+	if _, err := NewRedisCache(server.addr(), "", 0, "apiproxy:", 0, nil, nil); err == nil {
+		t.Errorf("Unreachable redis accepted")
+	}
+}
@@ -0,0 +1,120 @@
+package apiproxy
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Settings only read at startup. Changes to these are logged and ignored
+// until the next restart.
+var staticSettings = []string{
+	"Listen",
+	"Listeners",
+	"Upstreams",
+	"Replay",
+	"CacheBackend",
+	"CacheDir",
+	"FastStart",
+	"MaxCacheBytes",
+	"MaxCacheEntries",
+	"EvictionPolicy",
+	"CacheCompression",
+	"StaleWhileRevalidate",
+	"StaleIfError",
+	"MemoryCacheEntries",
+	"RedisAddr",
+	"RedisPassword",
+	"RedisDB",
+	"RedisPrefix",
+	"Priority.Classes",
+	"Prewarm.Keys",
+}
+
+// Finds a possibly nested field of the config by its dotted name.
+func configField(c *Config, name string) reflect.Value {
+	v := reflect.ValueOf(c).Elem()
+	for _, part := range strings.Split(name, ".") {
+		v = v.FieldByName(part)
+	}
+	return v
+}
+
+// Copies any static settings that differ from the running config back into
+// newConfig, returning the names of those that changed.
+func keepStaticSettings(running, newConfig *Config) []string {
+	var changed []string
+	for _, name := range staticSettings {
+		current := configField(running, name)
+		loaded := configField(newConfig, name)
+		if !reflect.DeepEqual(current.Interface(), loaded.Interface()) {
+			changed = append(changed, name)
+			loaded.Set(current)
+		}
+	}
+	return changed
+}
+
+// Reload applies a new configuration to the running server. Settings that
+// can't be changed while running are logged and keep their current values. A
+// config that fails to apply leaves everything as it was.
+func (s *Server) Reload(newConfig Config) error {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	// Validate with the static settings that will actually be running, the
+	// rest of the config may depend on them.
+	old := s.getConf()
+	changed := keepStaticSettings(old, &newConfig)
+	err := validateConfig(newConfig)
+	if err != nil {
+		return err
+	}
+	for _, name := range changed {
+		s.log.Printf("Config reload: %s can't be changed while running, restart to apply it.", name)
+	}
+
+	// Open the new logs before touching anything so a bad path changes nothing.
+	logs, err := s.openLogs(newConfig.Logging)
+	if err != nil {
+		return err
+	}
+
+	conf := &newConfig
+	s.conf.Store(conf)
+	s.useLogs(logs)
+
+	// New limiters forget recent errors, so only replace them on a change.
+	if conf.RequestsPerSecond != old.RequestsPerSecond || conf.MaxErrors != old.MaxErrors ||
+		conf.ErrorPeriod != old.ErrorPeriod {
+		s.resetLimiters(conf)
+	}
+
+	if conf.Priority.Default != old.Priority.Default {
+		s.workQueue.SetDefault(conf.Priority.Default)
+	}
+
+	if conf.Workers != old.Workers {
+		s.log.Printf("Config reload: changing from %d to %d workers.", old.Workers, conf.Workers)
+		if s.started {
+			s.resizeWorkers(conf.Workers)
+		}
+		s.defaultUpstream.client.SetMaxIdleConns(conf.Workers)
+		for _, u := range s.upstreams {
+			u.client.SetMaxIdleConns(conf.Workers)
+		}
+	}
+	s.defaultUpstream.configureClient(conf, UpstreamConfig{})
+	for _, uc := range conf.Upstreams {
+		s.upstreams[uc.Name].configureClient(conf, uc)
+	}
+
+	// Clients pick up their new quotas the next time they're seen. Forgetting
+	// them loses their recent requests and errors, so only do it on a change.
+	if !reflect.DeepEqual(conf.Quota, old.Quota) || conf.ErrorPeriod != old.ErrorPeriod {
+		s.clientsLock.Lock()
+		s.clients = make(map[string]*clientLimits)
+		s.clientsLock.Unlock()
+	}
+
+	return nil
+}
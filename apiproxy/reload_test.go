@@ -0,0 +1,84 @@
+package apiproxy
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func newReloadTestServer(t *testing.T, conf Config) *Server {
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestReloadValidatesRunningClasses(t *testing.T) {
+	s := newReloadTestServer(t, DefaultConfig())
+
+	// Classes can't change while running, so a default naming a new class
+	// would name one that doesn't exist.
+	conf := s.Config()
+	conf.Priority.Classes = []PriorityClass{{"new", 1}}
+	conf.Priority.Default = "new"
+	if err := s.Reload(conf); err == nil {
+		t.Errorf("Reload accepted a default class that isn't running")
+	}
+
+	conf = s.Config()
+	conf.Priority.Classes = []PriorityClass{{"new", 1}}
+	conf.Priority.Clients = []PriorityClient{{"127.0.0.1", "new"}}
+	if err := s.Reload(conf); err == nil {
+		t.Errorf("Reload accepted a client class that isn't running")
+	}
+
+	if s.Config().Priority.Default != "normal" {
+		t.Errorf("Failed reload changed the default class to %s", s.Config().Priority.Default)
+	}
+}
+
+func TestReloadKeepsClientsUnlessQuotaChanges(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Quota.RequestsPerSecond = 10
+	s := newReloadTestServer(t, conf)
+
+	cl := s.getClientLimits(s.getConf(), "client")
+	conf = s.Config()
+	conf.Workers++
+	if err := s.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	if s.getClientLimits(s.getConf(), "client") != cl {
+		t.Errorf("Reload without a quota change forgot the client")
+	}
+
+	conf = s.Config()
+	conf.Quota.RequestsPerSecond = 20
+	if err := s.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	if s.getClientLimits(s.getConf(), "client") == cl {
+		t.Errorf("Client kept its old limits after a quota change")
+	}
+}
+
+func TestReloadUpdatesUpstreamClients(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Upstreams = []UpstreamConfig{
+		{Name: "plain", BaseURL: "http://127.0.0.1:1"},
+		{Name: "own", BaseURL: "http://127.0.0.1:2", UserAgent: "own agent"},
+	}
+	s := newReloadTestServer(t, conf)
+
+	conf = s.Config()
+	conf.UserAgent = "new agent"
+	if err := s.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"": "new agent", "plain": "new agent", "own": "own agent"} {
+		if ua := s.getUpstream(name).client.UserAgent; ua != expected {
+			t.Errorf("Upstream %q has user agent %q after reload, expected %q", name, ua, expected)
+		}
+	}
+}
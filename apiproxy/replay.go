@@ -0,0 +1,237 @@
+package apiproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+// One upstream exchange in a replay archive. Archives are JSON, one exchange
+// per line.
+type replayEntry struct {
+	Time     time.Time         `json:"time"`
+	Upstream string            `json:"upstream,omitempty"`
+	URL      string            `json:"url"`
+	Params   map[string]string `json:"params"`
+
+	HTTPCode   int    `json:"httpCode"`
+	ErrorCode  int    `json:"errorCode,omitempty"`
+	ErrorText  string `json:"errorText,omitempty"`
+	Invalidate bool   `json:"invalidate,omitempty"`
+	Body       string `json:"body"`
+	Err        string `json:"err,omitempty"`
+
+	// Seconds, the response's cache time and how long the API took.
+	CacheFor float64 `json:"cacheFor"`
+	Latency  float64 `json:"latency"`
+}
+
+// Whether apicache cached the recorded response, which it does for anything
+// the API answered but not for a failure to reach it.
+func (e replayEntry) cacheable() bool {
+	return e.Err == "" || e.ErrorCode != 0
+}
+
+// vCodes are never written down, their hash still tells requests apart.
+func redactParams(params map[string]string) map[string]string {
+	redacted := make(map[string]string, len(params))
+	for k, v := range params {
+		if strings.ToLower(k) == "vcode" {
+			v = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(v)))
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// Identifies an exchange, the same for a live call and its recording.
+func replayKey(upstream, url string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = strings.ToLower(k) + "=" + params[k]
+	}
+	return upstream + " " + strings.ToLower(url) + "?" + strings.Join(pairs, "&")
+}
+
+type replayRecorder struct {
+	fp  *os.File
+	log *log.Logger
+	sync.Mutex
+}
+
+func (r *replayRecorder) record(call apiCall, resp *apicache.Response, err error, latency time.Duration) {
+	now := time.Now()
+	entry := replayEntry{
+		Time:     now,
+		Upstream: call.upstream.name,
+		URL:      call.url,
+		Params:   redactParams(call.params),
+		Latency:  latency.Seconds(),
+	}
+	if resp != nil {
+		entry.HTTPCode = resp.HTTPCode
+		entry.ErrorCode = resp.Error.ErrorCode
+		entry.ErrorText = resp.Error.ErrorText
+		entry.Invalidate = resp.Invalidate
+		entry.Body = string(resp.Data)
+		entry.CacheFor = resp.Expires.Sub(now).Seconds()
+	}
+	if err != nil {
+		entry.Err = err.Error()
+	}
+
+	data, jerr := json.Marshal(entry)
+	if jerr != nil {
+		r.log.Printf("Unknown JSON Marshal Error: %s", jerr)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	_, werr := r.fp.Write(append(data, '\n'))
+	if werr != nil {
+		r.log.Printf("Error recording to replay archive: %s", werr)
+	}
+}
+
+func (r *replayRecorder) close() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.fp.Close()
+}
+
+// Answers calls from a replay archive. Identical calls get the recorded
+// responses in the order they were recorded, the last one repeating once
+// they run out.
+type replayPlayer struct {
+	entries map[string][]replayEntry
+	next    map[string]int
+	timing  bool
+	sync.Mutex
+}
+
+func loadReplay(filename string, timing bool) (*replayPlayer, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	p := &replayPlayer{
+		entries: make(map[string][]replayEntry),
+		next:    make(map[string]int),
+		timing:  timing,
+	}
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var entry replayEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", filename, line, err)
+		}
+		key := replayKey(entry.Upstream, entry.URL, entry.Params)
+		p.entries[key] = append(p.entries[key], entry)
+	}
+	return p, scanner.Err()
+}
+
+// Returns the next recorded response for a call, and whether it should be
+// cached.
+func (p *replayPlayer) answer(call apiCall) (*apicache.Response, bool, error) {
+	key := replayKey(call.upstream.name, call.url, redactParams(call.params))
+
+	p.Lock()
+	entries := p.entries[key]
+	if len(entries) == 0 {
+		p.Unlock()
+		errStr := fmt.Sprintf("APIProxy Error: No recorded response for %s.", call.url)
+		return &apicache.Response{
+			Data:     apicache.SynthesizeAPIError(500, errStr, time.Minute),
+			Expires:  time.Now().Add(time.Minute),
+			Error:    apicache.APIError{ErrorCode: 500, ErrorText: errStr},
+			HTTPCode: 500,
+		}, false, nil
+	}
+	i := p.next[key]
+	if i < len(entries)-1 {
+		p.next[key] = i + 1
+	}
+	entry := entries[i]
+	p.Unlock()
+
+	if p.timing {
+		time.Sleep(time.Duration(entry.Latency * float64(time.Second)))
+	}
+
+	resp := &apicache.Response{
+		Data:       []byte(entry.Body),
+		Expires:    time.Now().Add(time.Duration(entry.CacheFor * float64(time.Second))),
+		Error:      apicache.APIError{ErrorCode: entry.ErrorCode, ErrorText: entry.ErrorText},
+		HTTPCode:   entry.HTTPCode,
+		Invalidate: entry.Invalidate,
+	}
+	var err error
+	if entry.Err != "" {
+		err = fmt.Errorf("%s", entry.Err)
+	}
+	return resp, entry.cacheable(), err
+}
+
+// Answers a call from the replay archive in place of the API, caching the
+// response the way apicache does for a live one.
+func (s *Server) replay(call apiCall) (*apicache.Response, error) {
+	resp, cacheable, err := s.replayer.answer(call)
+	if cacheable {
+		serr := s.storeResponse(call.tag(), call.key(), resp.HTTPCode, resp.Data, resp.Expires)
+		if serr != nil {
+			s.log.Printf("Error caching replayed response for %s: %s", call.url, serr)
+		}
+	}
+	return resp, err
+}
+
+// Sets up recording or replaying as configured.
+func (s *Server) startReplay() error {
+	c := s.getConf().Replay
+	switch {
+	case c.Replay != "":
+		p, err := loadReplay(c.Replay, c.Timing)
+		if err != nil {
+			return fmt.Errorf("Error loading replay archive: %s", err)
+		}
+		s.replayer = p
+		s.log.Printf("Replaying %d recorded requests from %s, the API will not be contacted.", len(p.entries), c.Replay)
+	case c.Record != "":
+		fp, err := os.OpenFile(c.Record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("Error opening replay archive: %s", err)
+		}
+		s.recorder = &replayRecorder{fp: fp, log: s.log}
+		s.log.Printf("Recording API requests to %s.", c.Record)
+	}
+	return nil
+}
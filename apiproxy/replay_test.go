@@ -0,0 +1,92 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Runs a server with a memory cache and a named upstream at baseURL on /test,
+// recording or replaying as set in rc.
+func newReplayTestServer(t *testing.T, baseURL string, rc ReplayConfig) *Server {
+	conf := DefaultConfig()
+	conf.Workers = 2
+	conf.Retries = 1
+	conf.Replay = rc
+	conf.Upstreams = []UpstreamConfig{{Name: "test", BaseURL: baseURL, PathPrefix: "/test"}}
+
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(100, 0, nil)), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	return s
+}
+
+func getBody(t *testing.T, s *Server, url string) string {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if w.Code != 200 {
+		t.Fatalf("%s got HTTP %d: %s", url, w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "replay.jsonl")
+
+	// Every call to the API gets a different answer.
+	var calls int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		now := time.Now().UTC()
+		fmt.Fprintf(w, `<?xml version='1.0' encoding='UTF-8'?>
+<eveapi version="2"><currentTime>%s</currentTime><result><call>%d</call></result><cachedUntil>%s</cachedUntil></eveapi>`,
+			now.Format("2006-01-02 15:04:05"), n, now.Add(time.Hour).Format("2006-01-02 15:04:05"))
+	}))
+
+	url := "/test/account/characters.xml.aspx?keyID=1&vCode=abc"
+	requests := []string{url, url, url + "&force=1"}
+
+	s := newReplayTestServer(t, api.URL, ReplayConfig{Record: archive})
+	var recorded []string
+	for _, r := range requests {
+		recorded = append(recorded, getBody(t, s, r))
+	}
+	shutdownTestServer(t, s)
+	api.Close()
+
+	if calls != 2 {
+		t.Fatalf("Recording made %d API calls, expected 2", calls)
+	}
+	if recorded[0] != recorded[1] || recorded[1] == recorded[2] {
+		t.Fatalf("Unexpected recorded responses %q", recorded)
+	}
+
+	// The API is gone, replaying has to give the same answers with the
+	// second request served from the cache.
+	s = newReplayTestServer(t, api.URL, ReplayConfig{Replay: archive})
+	defer shutdownTestServer(t, s)
+	for i, r := range requests {
+		body := getBody(t, s, r)
+		if body != recorded[i] {
+			t.Errorf("Replayed request %d got %q, recorded %q", i, body, recorded[i])
+		}
+	}
+
+	if !strings.Contains(recorded[2], "<call>2</call>") {
+		t.Errorf("Forced request answered by call %q, expected the second", recorded[2])
+	}
+}
@@ -0,0 +1,240 @@
+package apiproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Name of the class used for prewarming and other jobs nobody is waiting on.
+// It has no weight and only runs when every other queue is empty.
+const backgroundClass = "background"
+
+type queueClass struct {
+	name   string
+	weight int
+
+	// Smooth weighted round robin state.
+	current int
+
+	jobs   []apiReq
+	served int64
+}
+
+// priorityQueue feeds jobs to the workers from one queue per priority class,
+// sharing workers between classes in proportion to their weights.
+type priorityQueue struct {
+	classes      []*queueClass
+	defaultClass int
+
+	closed bool
+	paused bool
+	retire int
+	cond   *sync.Cond
+	sync.Mutex
+}
+
+func newPriorityQueue(classes []PriorityClass, defaultClass string) *priorityQueue {
+	q := &priorityQueue{}
+	q.cond = sync.NewCond(q)
+
+	for _, c := range classes {
+		q.classes = append(q.classes, &queueClass{name: strings.ToLower(c.Name), weight: c.Weight})
+	}
+	q.classes = append(q.classes, &queueClass{name: backgroundClass})
+	q.defaultClass = q.findClass(defaultClass)
+
+	return q
+}
+
+// Returns the index of the named class, or the default class if there is no
+// such class.
+func (q *priorityQueue) class(name string) int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.findClass(name)
+}
+
+// Must be called with the lock held, or before the queue is in use.
+func (q *priorityQueue) findClass(name string) int {
+	name = strings.ToLower(name)
+	for i, c := range q.classes {
+		if c.name == name {
+			return i
+		}
+	}
+	return q.defaultClass
+}
+
+// Changes the class used for requests that don't ask for one.
+func (q *priorityQueue) SetDefault(name string) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.defaultClass = q.findClass(name)
+}
+
+// Returned by Push once the queue has been closed and no worker is left to
+// take the job.
+var errQueueClosed = errors.New("Work queue closed")
+
+func (q *priorityQueue) Push(class int, req apiReq) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+	q.classes[class].jobs = append(q.classes[class].jobs, req)
+	q.cond.Signal()
+	return nil
+}
+
+// Picks the next class to serve, must be called with the lock held.
+func (q *priorityQueue) pick() *queueClass {
+	var best *queueClass
+	total := 0
+
+	for _, c := range q.classes {
+		if len(c.jobs) == 0 || c.weight <= 0 {
+			continue
+		}
+		c.current += c.weight
+		total += c.weight
+		if best == nil || c.current > best.current {
+			best = c
+		}
+	}
+	if best != nil {
+		best.current -= total
+		return best
+	}
+
+	// Nothing weighted waiting, unweighted classes get a turn.
+	for _, c := range q.classes {
+		if len(c.jobs) > 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// Blocks until there's a job to hand out. Returns false once the queue has
+// been closed and emptied, or when the calling worker should retire.
+func (q *priorityQueue) Pop() (apiReq, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for {
+		if q.retire > 0 {
+			q.retire--
+			return apiReq{}, false
+		}
+		if q.paused && !q.closed {
+			q.cond.Wait()
+			continue
+		}
+		if c := q.pick(); c != nil {
+			req := c.jobs[0]
+			c.jobs[0] = apiReq{}
+			c.jobs = c.jobs[1:]
+			c.served++
+			return req, true
+		}
+		if q.closed {
+			return apiReq{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// Has n workers stop the next time they ask for a job.
+func (q *priorityQueue) Retire(n int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.retire += n
+	q.cond.Broadcast()
+}
+
+// Takes back up to n retirements that haven't happened yet, returning how
+// many were taken back.
+func (q *priorityQueue) Unretire(n int) int {
+	q.Lock()
+	defer q.Unlock()
+
+	if n > q.retire {
+		n = q.retire
+	}
+	q.retire -= n
+	return n
+}
+
+// While paused jobs are queued but not handed out.
+func (q *priorityQueue) SetPaused(paused bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.paused = paused
+	q.cond.Broadcast()
+}
+
+func (q *priorityQueue) Paused() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.paused
+}
+
+// Stops the workers once they've finished what's already queued.
+func (q *priorityQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *priorityQueue) LogStats(w io.Writer) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.paused {
+		fmt.Fprintf(w, "Workers paused.\n")
+	}
+	for _, c := range q.classes {
+		fmt.Fprintf(w, "Queue %s (weight %d): %d waiting, %d served.\n", c.name, c.weight, len(c.jobs), c.served)
+	}
+}
+
+type queueStat struct {
+	Class   string
+	Weight  int
+	Waiting int
+	Served  int64
+	Paused  bool
+}
+
+func (q *priorityQueue) Stats() []queueStat {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := make([]queueStat, len(q.classes))
+	for i, c := range q.classes {
+		stats[i] = queueStat{c.name, c.weight, len(c.jobs), c.served, q.paused}
+	}
+	return stats
+}
+
+func (q *priorityQueue) writeMetrics(w io.Writer) {
+	q.Lock()
+	defer q.Unlock()
+
+	fmt.Fprintf(w, "# HELP apiproxy_queue_depth Jobs waiting for a worker by priority class.\n# TYPE apiproxy_queue_depth gauge\n")
+	for _, c := range q.classes {
+		fmt.Fprintf(w, "apiproxy_queue_depth{class=%q} %d\n", c.name, len(c.jobs))
+	}
+}
@@ -0,0 +1,74 @@
+package apiproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+// Fills every class of a queue with n jobs, each job's url naming its class.
+func fillQueue(t *testing.T, q *priorityQueue, n int) {
+	for i, c := range q.classes {
+		for j := 0; j < n; j++ {
+			err := q.Push(i, apiReq{call: apiCall{url: c.name}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// Pops n jobs, returning the classes they came from.
+func popClasses(q *priorityQueue, n int) []string {
+	var order []string
+	for i := 0; i < n; i++ {
+		req, ok := q.Pop()
+		if !ok {
+			break
+		}
+		order = append(order, req.call.url)
+	}
+	return order
+}
+
+func TestPriorityQueueSmoothOrder(t *testing.T) {
+	q := newPriorityQueue([]PriorityClass{{"a", 5}, {"b", 1}, {"c", 1}}, "a")
+	fillQueue(t, q, 20)
+
+	// Smooth weighted round robin spreads a heavy class out instead of
+	// serving it in one burst.
+	order := strings.Join(popClasses(q, 14), " ")
+	expected := "a a b a c a a a a b a c a a"
+	if order != expected {
+		t.Errorf("Served %s, expected %s", order, expected)
+	}
+}
+
+func TestPriorityQueueProportions(t *testing.T) {
+	q := newPriorityQueue([]PriorityClass{{"interactive", 8}, {"normal", 4}, {"bulk", 1}}, "normal")
+	fillQueue(t, q, 1000)
+
+	counts := make(map[string]int)
+	for _, class := range popClasses(q, 13*50) {
+		counts[class]++
+	}
+	if counts["interactive"] != 400 || counts["normal"] != 200 || counts["bulk"] != 50 || counts[backgroundClass] != 0 {
+		t.Errorf("Served %v, expected 400 interactive, 200 normal, 50 bulk and no background", counts)
+	}
+}
+
+func TestPriorityQueueBackgroundLast(t *testing.T) {
+	q := newPriorityQueue([]PriorityClass{{"normal", 1}}, "normal")
+	background := q.class(backgroundClass)
+	q.Push(background, apiReq{call: apiCall{url: backgroundClass}})
+	q.Push(q.class("normal"), apiReq{call: apiCall{url: "normal"}})
+	q.Push(q.class("unknown"), apiReq{call: apiCall{url: "normal"}})
+	q.Close()
+
+	order := strings.Join(popClasses(q, 4), " ")
+	if order != "normal normal background" {
+		t.Errorf("Served %s, expected normal normal background", order)
+	}
+	if err := q.Push(background, apiReq{}); err != errQueueClosed {
+		t.Errorf("Push to a closed queue gave %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inominate/apicache"
+	"github.com/inominate/ratelimit"
+)
+
+// Server is an API proxy with its own configuration, cache, rate limiters and
+// worker pool. Any number of them can run side by side in one process.
+type Server struct {
+	// Counters updated atomically, first to keep them aligned.
+	coalescedCount              int64
+	staleCount, staleErrorCount int64
+	activeWorkerCount           int32
+	workerCount                 int32
+
+	// The running *Config, replaced whole on every change so a request can
+	// work from one snapshot. Changes are made holding confLock.
+	conf     atomic.Value
+	confLock sync.Mutex
+
+	log       *log.Logger
+	debugLog  *log.Logger
+	accessLog *log.Logger
+
+	// Where logs go when no log file is configured, nil for the default.
+	logOutput       io.Writer
+	accessLogOutput io.Writer
+	logFiles        []*logFile
+	logFilesLock    sync.Mutex
+
+	cache CacheBackend
+	// Whether NewServer opened the cache, and so Shutdown should close it.
+	ownCache bool
+	// Keys of the requests in the hands of the workers, stored with their
+	// responses.
+	storeKeys *storeKeys
+
+	rateLimiter      *ratelimit.RateLimit
+	errorRateLimiter *ratelimit.RateLimit
+	limitersLock     sync.RWMutex
+
+	defaultUpstream *upstream
+	upstreams       map[string]*upstream
+	// Upstreams with a PathPrefix, longest prefix first.
+	routes []*upstream
+
+	// Queue for sending jobs to workers.
+	workQueue *priorityQueue
+
+	// Jobs handled by each worker, indexed by worker ID.
+	workCount     []int32
+	workCountLock sync.RWMutex
+
+	// Number of workers we want running, workers beyond it are retiring.
+	workerTarget int
+
+	flights     map[string]*flight
+	flightsLock sync.Mutex
+
+	// Keys currently being refreshed in the background.
+	refreshing     map[string]bool
+	refreshingLock sync.Mutex
+
+	clients     map[string]*clientLimits
+	clientsLock sync.Mutex
+
+	warmer  *prewarmer
+	history statsHistory
+	metrics serverMetrics
+
+	recorder *replayRecorder
+	replayer *replayPlayer
+
+	httpServer *http.Server
+
+	started, stopped bool
+	// Closed on shutdown to stop the background jobs.
+	done chan struct{}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// An Option changes how NewServer sets up a Server.
+type Option func(*Server)
+
+// WithConfig runs the server with c instead of the defaults.
+func WithConfig(c Config) Option {
+	return func(s *Server) {
+		s.conf.Store(&c)
+	}
+}
+
+// WithCache stores responses in c instead of the cache backend configured.
+func WithCache(c CacheBackend) Option {
+	return func(s *Server) {
+		s.cache = c
+	}
+}
+
+// WithLogOutput sends the logs to w instead of standard output when no log
+// file is configured. With the json access log format the default is
+// standard error, leaving standard output to the access log.
+func WithLogOutput(w io.Writer) Option {
+	return func(s *Server) {
+		s.logOutput = w
+	}
+}
+
+// WithAccessLogOutput sends the json access log to w instead of standard
+// output when no access log file is configured.
+func WithAccessLogOutput(w io.Writer) Option {
+	return func(s *Server) {
+		s.accessLogOutput = w
+	}
+}
+
+// NewServer sets up a Server from the given options, using the default
+// configuration unless one is given. The server does nothing until Start is
+// called.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		upstreams:  make(map[string]*upstream),
+		flights:    make(map[string]*flight),
+		refreshing: make(map[string]bool),
+		clients:    make(map[string]*clientLimits),
+		storeKeys:  newStoreKeys(),
+		metrics:    newServerMetrics(),
+		done:       make(chan struct{}),
+	}
+	defaults := DefaultConfig()
+	s.conf.Store(&defaults)
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	conf := s.getConf()
+	err := validateConfig(*conf)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := s.openLogs(conf.Logging)
+	if err != nil {
+		return nil, err
+	}
+	logflag := log.Ldate | log.Ltime
+	s.log = log.New(logs.log, "", logflag)
+	s.accessLog = log.New(logs.access, "", 0)
+	s.debugLog = log.New(logs.debug, "DEBUG ", logflag)
+	s.logFiles = logs.files
+
+	s.ownCache = s.cache == nil
+	if s.ownCache {
+		s.log.Printf("Initializing %s Cache...", conf.CacheBackend)
+		s.cache, err = NewCacheBackend(*conf, s.log, s.debugLog)
+		if err != nil {
+			s.closeLogs()
+			return nil, fmt.Errorf("Error initializing cache: %s", err)
+		}
+		s.log.Printf("Done.")
+	}
+
+	err = s.startUpstreams()
+	if err != nil {
+		s.closeCache()
+		s.closeLogs()
+		return nil, err
+	}
+
+	client := apicache.NewClient(upstreamCache{"", s})
+	client.SetMaxIdleConns(conf.Workers)
+	// We do our own retrying, we don't want the apicache to do them for us.
+	client.Retries = 0
+	s.defaultUpstream = &upstream{client: client}
+	s.defaultUpstream.configureClient(conf, UpstreamConfig{})
+
+	s.resetLimiters(conf)
+
+	err = s.startReplay()
+	if err != nil {
+		s.closeUpstreams()
+		s.closeCache()
+		s.closeLogs()
+		return nil, err
+	}
+
+	s.workQueue = newPriorityQueue(conf.Priority.Classes, conf.Priority.Default)
+	s.workCount = make([]int32, 1)
+	s.warmer = newPrewarmer(s)
+
+	s.httpServer = &http.Server{
+		Handler:      s,
+		ReadTimeout:  70 * time.Second,
+		WriteTimeout: 70 * time.Second,
+	}
+	return s, nil
+}
+
+// Start runs the workers and background jobs, after which the server can
+// handle requests.
+func (s *Server) Start() {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+
+	s.startWorkers()
+	s.warmer.start()
+	go s.clientPurger()
+	go s.statsCollector()
+}
+
+// ListenAndServe serves on every configured listener until Shutdown, when it
+// returns http.ErrServerClosed. Every listener is opened before anything is
+// served so a bad one fails early.
+func (s *Server) ListenAndServe() error {
+	var listeners []net.Listener
+	for _, l := range configListeners(*s.getConf()) {
+		ln, err := l.listen()
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("Error starting listener %s: %s", l, err)
+		}
+		s.log.Printf("Listening on %s", l)
+		listeners = append(listeners, ln)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- s.httpServer.Serve(ln)
+		}(ln)
+	}
+
+	var err error
+	for range listeners {
+		e := <-errs
+		if e != http.ErrServerClosed && err == nil {
+			err = e
+			s.httpServer.Close()
+		}
+	}
+	if err == nil {
+		err = http.ErrServerClosed
+	}
+	return err
+}
+
+// Config returns the configuration in use.
+func (s *Server) Config() Config {
+	return *s.getConf()
+}
+
+// Returns the configuration in use, which must not be modified. Anything
+// reading more than one setting should hold on to the same snapshot.
+func (s *Server) getConf() *Config {
+	return s.conf.Load().(*Config)
+}
+
+// Logger returns the server's general log, which follows the Logging
+// settings across reloads.
+func (s *Server) Logger() *log.Logger {
+	return s.log
+}
+
+// DebugLogger returns the server's debug log, which discards everything
+// unless debug logging is enabled.
+func (s *Server) DebugLogger() *log.Logger {
+	return s.debugLog
+}
+
+func userAgent(c *Config) string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return "eve-api-proxy by Innominate - http://github.com/inominate/eve-api-proxy"
+}
+
+// Changes the request and error limits of the running config, replacing the
+// rate limiters. A limit of 0 keeps its current value. Returns the new config.
+func (s *Server) setLimits(rps, maxErrors int) *Config {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	c := *s.getConf()
+	if rps > 0 {
+		c.RequestsPerSecond = rps
+	}
+	if maxErrors > 0 {
+		c.MaxErrors = maxErrors
+	}
+	s.conf.Store(&c)
+	s.resetLimiters(&c)
+	return &c
+}
+
+// Replaces the rate limiters, the server's and every named upstream's, with
+// new ones for the limits in c. Jobs already running finish with the limiters
+// they started with, and the new error limiters start with a clean slate.
+func (s *Server) resetLimiters(c *Config) {
+	s.limitersLock.Lock()
+	defer s.limitersLock.Unlock()
+
+	s.errorRateLimiter = ratelimit.NewRateLimit(c.MaxErrors, time.Duration(c.ErrorPeriod)*time.Second)
+	s.rateLimiter = ratelimit.NewRateLimit(c.RequestsPerSecond, time.Second)
+	for _, u := range s.upstreams {
+		u.resetLimiters(c)
+	}
+}
+
+// Returns the current request and error rate limiters.
+func (s *Server) getLimiters() (*ratelimit.RateLimit, *ratelimit.RateLimit) {
+	s.limitersLock.RLock()
+	defer s.limitersLock.RUnlock()
+
+	return s.rateLimiter, s.errorRateLimiter
+}
+
+// Writers for the general, debug and access logs along with the files behind
+// them.
+type logWriters struct {
+	log, debug, access io.Writer
+	files              []*logFile
+}
+
+func (w *logWriters) close() {
+	for _, f := range w.files {
+		f.Close()
+	}
+}
+
+// Opens the configured log files.
+func (s *Server) openLogs(c LogConfig) (*logWriters, error) {
+	jsonFormat := strings.ToLower(c.Format) == "json"
+
+	output := s.logOutput
+	if output == nil {
+		output = os.Stdout
+		// Keep standard output for json access records.
+		if jsonFormat && c.AccessLogFile == "" && s.accessLogOutput == nil {
+			output = os.Stderr
+		}
+	}
+
+	w := &logWriters{log: output, debug: ioutil.Discard}
+
+	if c.LogFile != "" {
+		lf, err := openLogFile(c.LogFile, c)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot Open Log File: %s", err)
+		}
+		w.log = lf
+		w.files = append(w.files, lf)
+	}
+
+	if c.Debug {
+		if c.DebugLogFile != c.LogFile {
+			if c.DebugLogFile == "" {
+				w.debug = output
+			} else {
+				lf, err := openLogFile(c.DebugLogFile, c)
+				if err != nil {
+					w.close()
+					return nil, fmt.Errorf("Cannot Open Debug Log File: %s", err)
+				}
+				w.debug = lf
+				w.files = append(w.files, lf)
+			}
+		} else {
+			w.debug = w.log
+		}
+	}
+
+	switch {
+	case c.AccessLogFile != "":
+		lf, err := openLogFile(c.AccessLogFile, c)
+		if err != nil {
+			w.close()
+			return nil, fmt.Errorf("Cannot Open Access Log File: %s", err)
+		}
+		w.access = lf
+		w.files = append(w.files, lf)
+	case jsonFormat:
+		w.access = s.accessLogOutput
+		if w.access == nil {
+			w.access = os.Stdout
+		}
+	default:
+		w.access = w.log
+	}
+
+	return w, nil
+}
+
+// Points the loggers at new writers and closes the files they used before.
+func (s *Server) useLogs(w *logWriters) {
+	s.log.SetOutput(w.log)
+	s.accessLog.SetOutput(w.access)
+	s.debugLog.SetOutput(w.debug)
+
+	s.logFilesLock.Lock()
+	old := s.logFiles
+	s.logFiles = w.files
+	s.logFilesLock.Unlock()
+
+	for _, f := range old {
+		f.Close()
+	}
+}
+
+// Closes the log files, anything logged afterwards is lost.
+func (s *Server) closeLogs() {
+	s.useLogs(&logWriters{log: ioutil.Discard, debug: ioutil.Discard, access: ioutil.Discard})
+}
@@ -0,0 +1,178 @@
+package apiproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, cacheDir string) (*Server, error) {
+	conf := DefaultConfig()
+	conf.CacheDir = cacheDir
+	conf.FastStart = true
+	conf.Workers = 2
+
+	return NewServer(WithConfig(conf), WithLogOutput(ioutil.Discard))
+}
+
+func shutdownTestServer(t *testing.T, s *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+}
+
+func TestServersSideBySide(t *testing.T) {
+	root, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	a, err := newTestServer(t, filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+
+	expires := time.Now().Add(time.Hour)
+	err = a.cache.Store(cacheTag("/a", nil), 200, []byte("a"), expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newTestServer(t, filepath.Join(root, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+
+	// Starting b with FastStart must leave a's cache alone.
+	_, data, _, err := a.cache.Get(cacheTag("/a", nil))
+	if err != nil || string(data) != "a" {
+		t.Errorf("Entry in first server's cache lost: %q %v", data, err)
+	}
+	if _, _, _, err := b.cache.Get(cacheTag("/a", nil)); err == nil {
+		t.Errorf("Second server sees the first server's cache")
+	}
+
+	b.Reload(func() Config { c := b.Config(); c.Workers = 3; return c }())
+	if a.Config().Workers != 2 || b.Config().Workers != 3 {
+		t.Errorf("Reload leaked between servers, workers %d and %d", a.Config().Workers, b.Config().Workers)
+	}
+
+	shutdownTestServer(t, a)
+	shutdownTestServer(t, b)
+}
+
+func TestServerCacheDirInUse(t *testing.T) {
+	root, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	a, err := newTestServer(t, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{root, root + "/", filepath.Join(root, "nested")} {
+		if _, err := newTestServer(t, dir); err == nil {
+			t.Errorf("Second server allowed to use cache directory %s", dir)
+		}
+	}
+
+	shutdownTestServer(t, a)
+
+	// Shutdown releases the directory.
+	b, err := newTestServer(t, root)
+	if err != nil {
+		t.Fatalf("Cache directory not released on shutdown: %s", err)
+	}
+	shutdownTestServer(t, b)
+}
+
+func TestServerNotRunning(t *testing.T) {
+	root, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := newTestServer(t, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/account/characters.xml.aspx", nil))
+		if w.Code != 503 {
+			t.Errorf("Request %s got HTTP %d, expected 503", when, w.Code)
+		}
+	}
+
+	check("before Start")
+	s.Start()
+	shutdownTestServer(t, s)
+	check("after Shutdown")
+}
+
+func TestServerShutdownTwice(t *testing.T) {
+	root, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := newTestServer(t, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	shutdownTestServer(t, s)
+	shutdownTestServer(t, s)
+
+	// Start after Shutdown does nothing.
+	s.Start()
+	shutdownTestServer(t, s)
+}
+
+func TestServerLeavesGivenCacheOpen(t *testing.T) {
+	root, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := NewDiskCache(root, false, CacheLimits{}, encodingNone, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	conf := DefaultConfig()
+	conf.FastStart = true
+	conf.Workers = 2
+	s, err := NewServer(WithConfig(conf), WithCache(cache), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	shutdownTestServer(t, s)
+
+	cache.RLock()
+	closed := cache.closed
+	cache.RUnlock()
+	if closed {
+		t.Errorf("Shutdown closed a cache the server didn't open")
+	}
+}
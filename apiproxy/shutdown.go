@@ -0,0 +1,63 @@
+package apiproxy
+
+import (
+	"context"
+)
+
+// Shutdown stops accepting requests, lets the workers drain the queue and
+// closes the log files, and the cache if NewServer opened it. Everything has
+// to be done before ctx is done, after which whatever is left is abandoned.
+// The server can't be started again afterwards. Later calls wait for the
+// first to finish and return its result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.log.Printf("Timed out waiting for requests to finish: %s", err)
+	}
+
+	s.confLock.Lock()
+	started := s.started
+	s.stopped = true
+	s.confLock.Unlock()
+
+	if started && !s.stopWorkers(ctx) {
+		waiting := 0
+		for _, q := range s.workQueue.Stats() {
+			waiting += q.Waiting
+		}
+		active, _ := s.GetWorkerStats()
+		s.log.Printf("Timed out draining workers, abandoning %d active and %d queued jobs.", active, waiting)
+	}
+	close(s.done)
+
+	s.closeUpstreams()
+	s.closeCache()
+	if s.recorder != nil {
+		s.recorder.close()
+	}
+
+	s.log.Printf("Shutdown complete.")
+	s.closeLogs()
+	return err
+}
+
+// Closes the cache, stopping its background cleanup, if it has anything to
+// close. Caches given to NewServer belong to the caller and are left open.
+func (s *Server) closeCache() {
+	if !s.ownCache {
+		return
+	}
+	if cc, ok := s.cache.(ClosableCache); ok {
+		err := cc.Close()
+		if err != nil {
+			s.log.Printf("Error closing cache: %s", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package apiproxy
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+// How long cache backends should hold on to entries after they expire.
+func staleRetention(c Config) time.Duration {
+	retain := c.StaleWhileRevalidate
+	if c.StaleIfError > retain {
+		retain = c.StaleIfError
+	}
+	return time.Duration(retain) * time.Second
+}
+
+// Anything past its expiration came out of the cache's retention period.
+func isStale(resp *apicache.Response) bool {
+	return resp.Expires.Before(time.Now())
+}
+
+// Only successful responses are worth serving stale, and only within the
+// given window in seconds.
+func canServeStale(resp *apicache.Response, window int) bool {
+	if window <= 0 || resp.HTTPCode != 200 || resp.Error.ErrorCode != 0 {
+		return false
+	}
+	return time.Since(resp.Expires) <= time.Duration(window)*time.Second
+}
+
+// Whether a response from the worker pool means the API couldn't be reached
+// or refused to serve us, rather than giving a real answer.
+func upstreamFailed(resp *apicache.Response, err error) bool {
+	return resp == nil || err != nil || resp.HTTPCode == 418 || resp.HTTPCode >= 500
+}
+
+// Refetches a request through the worker pool without anyone waiting on it,
+// the result lands in the cache for the next caller.
+func (s *Server) refreshInBackground(url string, params map[string]string) {
+	tag := requestTag(url, params)
+
+	s.refreshingLock.Lock()
+	if s.refreshing[tag] {
+		s.refreshingLock.Unlock()
+		return
+	}
+	s.refreshing[tag] = true
+	s.refreshingLock.Unlock()
+
+	apireq := s.newAPIRequest(url, params)
+	apireq.Force = true
+	call := s.newAPICall(url, params)
+	class := s.workQueue.class(params["priority"])
+
+	go func() {
+		defer func() {
+			s.refreshingLock.Lock()
+			delete(s.refreshing, tag)
+			s.refreshingLock.Unlock()
+		}()
+
+		resp, info, err := s.coalesce(tag, func() (*apicache.Response, fetchInfo, error) {
+			return s.fetchAPI(apireq, call, class)
+		})
+		if upstreamFailed(resp, err) {
+			s.debugLog.Printf("w%s: Background refresh of %s failed: %v", info.workerID, url, err)
+		}
+	}()
+}
+
+func (s *Server) PrintStaleStats(w io.Writer) {
+	fmt.Fprintf(w, "%d stale responses while refreshing, %d stale responses after errors.\n",
+		atomic.LoadInt64(&s.staleCount), atomic.LoadInt64(&s.staleErrorCount))
+}
@@ -0,0 +1,205 @@
+package apiproxy
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many per-minute snapshots to keep, 24 hours worth.
+const statsHistorySize = 24 * 60
+
+// Proxy health over one minute.
+type statsSnapshot struct {
+	Time time.Time
+
+	Requests  int64
+	RPS       float64
+	APIErrors int64
+
+	CacheHits   int64
+	CacheMisses int64
+	CacheStale  int64
+	HitRatio    float64
+
+	// Averaged over the minute.
+	ActiveWorkers float64
+}
+
+// Running totals the snapshots are taken from.
+type statsTotals struct {
+	requests, apiErrors     int64
+	hits, misses, staleHits int64
+}
+
+func (s *Server) currentTotals() statsTotals {
+	return statsTotals{
+		requests:  int64(s.metrics.requests.Total()),
+		apiErrors: int64(s.metrics.apiErrors.Total()),
+		hits:      int64(s.metrics.cache.Get("hit")),
+		misses:    int64(s.metrics.cache.Get("miss")),
+		staleHits: int64(s.metrics.cache.Get("stale")),
+	}
+}
+
+type statsHistory struct {
+	snapshots [statsHistorySize]statsSnapshot
+	next      int
+	count     int
+	sync.Mutex
+}
+
+func (h *statsHistory) add(s statsSnapshot) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.snapshots[h.next] = s
+	h.next = (h.next + 1) % statsHistorySize
+	if h.count < statsHistorySize {
+		h.count++
+	}
+}
+
+// Returns the snapshots oldest first.
+func (h *statsHistory) get() []statsSnapshot {
+	h.Lock()
+	defer h.Unlock()
+
+	snapshots := make([]statsSnapshot, 0, h.count)
+	start := (h.next - h.count + statsHistorySize) % statsHistorySize
+	for i := 0; i < h.count; i++ {
+		snapshots = append(snapshots, h.snapshots[(start+i)%statsHistorySize])
+	}
+	return snapshots
+}
+
+// Samples the worker count every second and records a snapshot every minute,
+// until the server shuts down.
+func (s *Server) statsCollector() {
+	last := s.currentTotals()
+	lastTime := time.Now()
+	var activeSum float64
+	samples := 0
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Second):
+		}
+
+		active, _ := s.GetWorkerStats()
+		activeSum += float64(active)
+		samples++
+		if samples < 60 {
+			continue
+		}
+
+		now := time.Now()
+		totals := s.currentTotals()
+		snap := statsSnapshot{
+			Time:          now,
+			Requests:      totals.requests - last.requests,
+			APIErrors:     totals.apiErrors - last.apiErrors,
+			CacheHits:     totals.hits - last.hits,
+			CacheMisses:   totals.misses - last.misses,
+			CacheStale:    totals.staleHits - last.staleHits,
+			ActiveWorkers: activeSum / float64(samples),
+		}
+		snap.RPS = float64(snap.Requests) / now.Sub(lastTime).Seconds()
+		if lookups := snap.CacheHits + snap.CacheMisses + snap.CacheStale; lookups > 0 {
+			snap.HitRatio = float64(snap.CacheHits+snap.CacheStale) / float64(lookups)
+		}
+		s.history.add(snap)
+
+		last = totals
+		lastTime = now
+		activeSum = 0
+		samples = 0
+	}
+}
+
+func (s *Server) statsJSONHandler(w http.ResponseWriter, req *http.Request) {
+	active, loaded := s.GetWorkerStats()
+	jobs := s.getWorkCounts()[1:]
+
+	conf := s.getConf()
+	rateLimiter, errorRateLimiter := s.getLimiters()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := map[string]interface{}{
+		"Time": time.Now(),
+		"Workers": map[string]interface{}{
+			"Loaded": loaded,
+			"Active": active,
+			"Jobs":   jobs,
+		},
+		"RateLimits": map[string]interface{}{
+			"RequestsPerSecond":   conf.RequestsPerSecond,
+			"Requests":            rateLimiter.Count(),
+			"RequestsOutstanding": rateLimiter.Outstanding(),
+			"MaxErrors":           conf.MaxErrors,
+			"ErrorPeriod":         conf.ErrorPeriod,
+			"Errors":              errorRateLimiter.Count(),
+			"ErrorsOutstanding":   errorRateLimiter.Outstanding(),
+		},
+		"Coalesced":       atomic.LoadInt64(&s.coalescedCount),
+		"StaleRefreshing": atomic.LoadInt64(&s.staleCount),
+		"StaleErrors":     atomic.LoadInt64(&s.staleErrorCount),
+		"Queues":          s.workQueue.Stats(),
+		"Clients":         s.clientStats(),
+		"Prewarm":         s.warmer.Stats(),
+		"Cache":           s.cacheStats(),
+		"Memory": map[string]uint64{
+			"Alloc":     m.Alloc,
+			"Sys":       m.Sys,
+			"HeapAlloc": m.HeapAlloc,
+			"HeapSys":   m.HeapSys,
+		},
+		"History": s.history.get(),
+	}
+
+	s.writeJSON(w, 200, stats)
+}
+
+func (s *Server) cacheStats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"Backend": s.getConf().CacheBackend,
+	}
+	if sc, ok := s.cache.(SizedCache); ok {
+		stats["Entries"], stats["Bytes"] = sc.Size()
+	}
+	if dc, ok := s.cache.(*DiskCache); ok {
+		stats["Evictions"] = atomic.LoadInt64(&dc.evictions)
+	}
+	return stats
+}
+
+type clientStat struct {
+	ID        string
+	Requests  int64
+	Errors    int64
+	OverQuota int64
+}
+
+func (s *Server) clientStats() []clientStat {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	stats := make([]clientStat, 0, len(s.clients))
+	for id, cl := range s.clients {
+		stats = append(stats, clientStat{
+			ID:        id,
+			Requests:  atomic.LoadInt64(&cl.requests),
+			Errors:    atomic.LoadInt64(&cl.errors),
+			OverQuota: atomic.LoadInt64(&cl.rejected),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
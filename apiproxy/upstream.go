@@ -0,0 +1,266 @@
+package apiproxy
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/inominate/apicache"
+	"github.com/inominate/ratelimit"
+)
+
+// An API server requests can be sent to. The default upstream talks to the
+// API apicache knows out of the box, using the server's limiters and cache.
+type upstream struct {
+	name   string
+	prefix string
+
+	client *apicache.Client
+	// Set when the upstream has TLS settings, see tlsBridge.
+	bridge *tlsBridge
+
+	// The upstream's own limits, 0 to follow the server's.
+	rps       int
+	maxErrors int
+
+	// Nil for the default upstream, which uses the server's limiters.
+	// Guarded by the server's limitersLock.
+	rateLimiter      *ratelimit.RateLimit
+	errorRateLimiter *ratelimit.RateLimit
+}
+
+// Sets the client's timeout and user agent from the global settings, unless
+// the upstream has its own.
+func (u *upstream) configureClient(conf *Config, uc UpstreamConfig) {
+	timeout := conf.APITimeout
+	if uc.Timeout > 0 {
+		timeout = uc.Timeout
+	}
+	u.client.SetTimeout(time.Duration(timeout) * time.Second)
+
+	u.client.UserAgent = userAgent(conf)
+	if uc.UserAgent != "" {
+		u.client.UserAgent = uc.UserAgent
+	}
+}
+
+// Returns the named upstream, or the default one for a blank name.
+func (s *Server) getUpstream(name string) *upstream {
+	if u, ok := s.upstreams[name]; ok {
+		return u
+	}
+	return s.defaultUpstream
+}
+
+// Returns the request and error rate limiters for an upstream.
+func (s *Server) upstreamLimiters(u *upstream) (*ratelimit.RateLimit, *ratelimit.RateLimit) {
+	s.limitersLock.RLock()
+	defer s.limitersLock.RUnlock()
+
+	if u.rateLimiter == nil {
+		return s.rateLimiter, s.errorRateLimiter
+	}
+	return u.rateLimiter, u.errorRateLimiter
+}
+
+// Replaces a named upstream's limiters, using the limits in c for any it
+// doesn't set itself. Must be called with the limiters lock held.
+func (u *upstream) resetLimiters(c *Config) {
+	rps := c.RequestsPerSecond
+	if u.rps > 0 {
+		rps = u.rps
+	}
+	maxErrors := c.MaxErrors
+	if u.maxErrors > 0 {
+		maxErrors = u.maxErrors
+	}
+	u.rateLimiter = ratelimit.NewRateLimit(rps, time.Second)
+	u.errorRateLimiter = ratelimit.NewRateLimit(maxErrors, time.Duration(c.ErrorPeriod)*time.Second)
+}
+
+// Gives an upstream's entries their own tags so upstreams sharing a backend
+// can't see each other's data. The default upstream keeps plain tags.
+func namespaceTag(name, tag string) string {
+	if name == "" {
+		return tag
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(name+"\x00"+tag)))
+}
+
+// The tag a request is stored under in the cache backend, including its
+// upstream's namespace.
+func requestTag(url string, params map[string]string) string {
+	return namespaceTag(params["upstream"], cacheTag(url, params))
+}
+
+// The cache an upstream's apicache client is given. Keeps the upstream's
+// entries apart from everyone else's in a shared backend, and has the server
+// store each with the key of the request it answers.
+type upstreamCache struct {
+	name string
+	s    *Server
+}
+
+func (u upstreamCache) Store(cacheTag string, HTTPCode int, data []byte, Expires time.Time) error {
+	tag := namespaceTag(u.name, cacheTag)
+	key, ok := u.s.storeKeys.get(tag)
+	if !ok {
+		u.s.debugLog.Printf("No request waiting on cache tag %s, storing it without a key.", tag)
+	}
+	return u.s.storeResponse(tag, key, HTTPCode, data, Expires)
+}
+
+func (u upstreamCache) Get(cacheTag string) (int, []byte, time.Time, error) {
+	return u.s.cache.Get(namespaceTag(u.name, cacheTag))
+}
+
+func (u upstreamCache) LogStats(w io.Writer) {
+	u.s.cache.LogStats(w)
+}
+
+// Stores a response under its namespaced tag along with the key of the
+// request it answers, if the backend can keep one.
+func (s *Server) storeResponse(tag, key string, HTTPCode int, data []byte, Expires time.Time) error {
+	if kc, ok := s.cache.(KeyedCache); ok {
+		return kc.StoreKeyed(tag, key, HTTPCode, data, Expires)
+	}
+	return s.cache.Store(tag, HTTPCode, data, Expires)
+}
+
+func validateUpstreams(c Config) error {
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+	for _, u := range c.Upstreams {
+		if u.Name == "" || names[u.Name] {
+			return fmt.Errorf("Invalid or duplicate upstream name %q", u.Name)
+		}
+		names[u.Name] = true
+
+		if !strings.HasPrefix(u.BaseURL, "http://") && !strings.HasPrefix(u.BaseURL, "https://") {
+			return fmt.Errorf("Upstream %s needs an http or https BaseURL", u.Name)
+		}
+		if u.PathPrefix != "" && (!strings.HasPrefix(u.PathPrefix, "/") || u.PathPrefix == "/") {
+			return fmt.Errorf("Upstream %s PathPrefix must start with / and not be just /", u.Name)
+		}
+		if u.PathPrefix != "" {
+			prefix := strings.TrimSuffix(u.PathPrefix, "/")
+			if other, ok := prefixes[prefix]; ok {
+				return fmt.Errorf("Upstreams %s and %s have the same PathPrefix %s", other, u.Name, prefix)
+			}
+			prefixes[prefix] = u.Name
+		}
+
+		if u.hasTLS() && !strings.HasPrefix(u.BaseURL, "https://") {
+			return fmt.Errorf("Upstream %s has TLS settings but no https BaseURL", u.Name)
+		}
+		if (u.ClientCert == "") != (u.ClientKey == "") {
+			return fmt.Errorf("Upstream %s needs both ClientCert and ClientKey", u.Name)
+		}
+	}
+	return nil
+}
+
+// Creates the named upstreams from the config.
+func (s *Server) startUpstreams() error {
+	conf := s.getConf()
+	for _, uc := range conf.Upstreams {
+		u := &upstream{
+			name:      uc.Name,
+			prefix:    strings.TrimSuffix(uc.PathPrefix, "/"),
+			rps:       uc.RequestsPerSecond,
+			maxErrors: uc.MaxErrors,
+		}
+
+		u.client = apicache.NewClient(upstreamCache{uc.Name, s})
+		u.client.BaseURL = strings.TrimSuffix(uc.BaseURL, "/")
+		if uc.hasTLS() {
+			err := s.bridgeUpstream(u, uc)
+			if err != nil {
+				s.closeUpstreams()
+				return fmt.Errorf("Error setting up TLS for upstream %s: %s", uc.Name, err)
+			}
+		}
+		u.client.Retries = 0
+		u.client.SetMaxIdleConns(conf.Workers)
+		u.configureClient(conf, uc)
+
+		s.upstreams[u.name] = u
+		if u.prefix != "" {
+			s.routes = append(s.routes, u)
+		}
+		s.log.Printf("Upstream %s at %s.", u.name, uc.BaseURL)
+	}
+
+	// Longest prefix first, so the most specific one wins.
+	sort.Slice(s.routes, func(i, j int) bool {
+		return len(s.routes[i].prefix) > len(s.routes[j].prefix)
+	})
+	return nil
+}
+
+// Points an upstream's client at a bridge applying its TLS settings.
+func (s *Server) bridgeUpstream(u *upstream, uc UpstreamConfig) error {
+	tlsConfig, err := uc.tlsConfig()
+	if err != nil {
+		return err
+	}
+	target, err := neturl.Parse(uc.BaseURL)
+	if err != nil {
+		return err
+	}
+
+	u.bridge, err = newTLSBridge(target, tlsConfig, s.log)
+	if err != nil {
+		return err
+	}
+	u.client.BaseURL = u.bridge.URL
+	return nil
+}
+
+// Shuts down any TLS bridges.
+func (s *Server) closeUpstreams() {
+	for _, u := range s.upstreams {
+		if u.bridge != nil {
+			u.bridge.Close()
+		}
+	}
+}
+
+// Picks the upstream for a request by the upstream header or the path prefix,
+// returning its name and the path with the prefix removed.
+func (s *Server) routeUpstream(conf *Config, req *http.Request, url string) (string, string, error) {
+	if conf.UpstreamHeader != "" {
+		if name := req.Header.Get(conf.UpstreamHeader); name != "" {
+			if _, ok := s.upstreams[name]; !ok {
+				return "", url, fmt.Errorf("Unknown upstream %s", name)
+			}
+			return name, url, nil
+		}
+	}
+
+	for _, u := range s.routes {
+		if url == u.prefix || strings.HasPrefix(url, u.prefix+"/") {
+			return u.name, strings.TrimPrefix(url, u.prefix), nil
+		}
+	}
+	return "", url, nil
+}
+
+func (s *Server) PrintUpstreamStats(w io.Writer) {
+	names := make([]string, 0, len(s.upstreams))
+	for name := range s.upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rateLimiter, errorRateLimiter := s.upstreamLimiters(s.upstreams[name])
+		fmt.Fprintf(w, "Upstream %s: %d requests in the last second, %d errors over last %d seconds.\n",
+			name, rateLimiter.Count(), errorRateLimiter.Count(), s.getConf().ErrorPeriod)
+	}
+}
@@ -0,0 +1,119 @@
+package apiproxy
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteUpstreamLongestPrefix(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Upstreams = []UpstreamConfig{
+		{Name: "test", BaseURL: "http://127.0.0.1:1", PathPrefix: "/test"},
+		{Name: "nested", BaseURL: "http://127.0.0.1:2", PathPrefix: "/test/nested/"},
+		{Name: "other", BaseURL: "http://127.0.0.1:3", PathPrefix: "/other"},
+	}
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path, name, url string
+	}{
+		{"/test/nested/account/characters.xml.aspx", "nested", "/account/characters.xml.aspx"},
+		{"/test/account/characters.xml.aspx", "test", "/account/characters.xml.aspx"},
+		{"/test/nestedx/a", "test", "/nestedx/a"},
+		{"/testx/a", "", "/testx/a"},
+		{"/account/characters.xml.aspx", "", "/account/characters.xml.aspx"},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		name, url, err := s.routeUpstream(s.getConf(), req, tc.path)
+		if err != nil || name != tc.name || url != tc.url {
+			t.Errorf("%s routed to %q %s (%v), expected %q %s", tc.path, name, url, err, tc.name, tc.url)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/a", nil)
+	req.Header.Set(conf.UpstreamHeader, "unknown")
+	if _, _, err := s.routeUpstream(s.getConf(), req, "/a"); err == nil {
+		t.Errorf("Unknown upstream in header accepted")
+	}
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	for _, upstreams := range [][]UpstreamConfig{
+		{{Name: "a", BaseURL: "http://a", PathPrefix: "/x"}, {Name: "b", BaseURL: "http://b", PathPrefix: "/x/"}},
+		{{Name: "a", BaseURL: "http://a"}, {Name: "a", BaseURL: "http://b"}},
+		{{Name: "a", BaseURL: "http://a", InsecureSkipVerify: true}},
+		{{Name: "a", BaseURL: "https://a", ClientCert: "client.crt"}},
+	} {
+		conf := DefaultConfig()
+		conf.Upstreams = upstreams
+		if err := validateUpstreams(conf); err == nil {
+			t.Errorf("Invalid upstreams %+v accepted", upstreams)
+		}
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now().UTC()
+		fmt.Fprintf(w, `<?xml version='1.0' encoding='UTF-8'?>
+<eveapi version="2"><currentTime>%s</currentTime><result><path>%s</path></result><cachedUntil>%s</cachedUntil></eveapi>`,
+			now.Format("2006-01-02 15:04:05"), req.URL.Path, now.Add(time.Hour).Format("2006-01-02 15:04:05"))
+	}))
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "apiproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.Certificate().Raw})
+	err = ioutil.WriteFile(caFile, ca, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := DefaultConfig()
+	conf.Workers = 1
+	conf.Retries = 1
+	conf.Upstreams = []UpstreamConfig{{Name: "tls", BaseURL: api.URL + "/base", PathPrefix: "/tls", CACert: caFile}}
+	s, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer shutdownTestServer(t, s)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/tls/account/characters.xml.aspx?keyID=1&vCode=abc", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "<path>/base/account/characters.xml.aspx</path>") {
+		t.Errorf("Request through TLS upstream got HTTP %d: %s", w.Code, w.Body.String())
+	}
+
+	// Without the CA the certificate can't be verified.
+	conf.Upstreams[0].CACert = ""
+	conf.Upstreams[0].ServerName = "example.com"
+	s2, err := NewServer(WithConfig(conf), WithCache(NewMemoryCache(10, 0, nil)), WithLogOutput(ioutil.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.Start()
+	defer shutdownTestServer(t, s2)
+
+	w = httptest.NewRecorder()
+	s2.ServeHTTP(w, httptest.NewRequest("GET", "/tls/account/characters.xml.aspx?keyID=1&vCode=abc", nil))
+	if w.Code == 200 {
+		t.Errorf("Request with an unverifiable certificate succeeded")
+	}
+}
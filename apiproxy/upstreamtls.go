@@ -0,0 +1,107 @@
+package apiproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	neturl "net/url"
+	"strings"
+)
+
+// Whether the upstream has TLS settings of its own.
+func (uc UpstreamConfig) hasTLS() bool {
+	return uc.CACert != "" || uc.ClientCert != "" || uc.ServerName != "" || uc.InsecureSkipVerify
+}
+
+func (uc UpstreamConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         uc.ServerName,
+		InsecureSkipVerify: uc.InsecureSkipVerify,
+	}
+
+	if uc.CACert != "" {
+		pem, err := ioutil.ReadFile(uc.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", uc.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if uc.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(uc.ClientCert, uc.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// apicache doesn't let us near the transport it uses, so an upstream with TLS
+// settings of its own is reached through a bridge: a reverse proxy on a
+// loopback port that apicache talks plain HTTP to, passing requests on to the
+// real BaseURL with the upstream's TLS settings. Only requests under a random
+// path are passed on, so nothing else on the machine can use it as a relay.
+type tlsBridge struct {
+	// What apicache should use as its BaseURL.
+	URL string
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func newTLSBridge(target *neturl.URL, tlsConfig *tls.Config, errorLog *log.Logger) (*tlsBridge, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	token := "/" + NewSecret()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(req.URL.Path, token)
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			// Nobody upstream needs to hear about the bridge.
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		ErrorLog: errorLog,
+	}
+
+	b := &tlsBridge{
+		URL:      "http://" + ln.Addr().String() + token,
+		listener: ln,
+	}
+	b.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !strings.HasPrefix(req.URL.Path, token+"/") {
+				http.NotFound(w, req)
+				return
+			}
+			proxy.ServeHTTP(w, req)
+		}),
+		ErrorLog: errorLog,
+	}
+	go b.server.Serve(ln)
+
+	return b, nil
+}
+
+func (b *tlsBridge) Close() error {
+	return b.server.Close()
+}
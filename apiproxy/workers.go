@@ -0,0 +1,457 @@
+package apiproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/inominate/apicache"
+)
+
+type apiReq struct {
+	apiReq  *apicache.Request
+	apiResp *apicache.Response
+
+	apiErr apicache.APIError
+
+	expires time.Time
+
+	call apiCall
+
+	worker   int
+	latency  time.Duration
+	httpCode int
+	err      error
+	respChan chan apiReq
+}
+
+// Parameters used by the proxy itself that are never sent to the API.
+var proxyParams = map[string]bool{
+	"force":    true,
+	"priority": true,
+	"client":   true,
+	"upstream": true,
+}
+
+// Details of a request's trip through the worker pool.
+type fetchInfo struct {
+	workerID string
+	retries  int
+	latency  time.Duration
+}
+
+// How APIReq answered a request, for the access log.
+type reqResult struct {
+	cacheStatus string
+	fetchInfo
+}
+
+// Builds an apicache request from the incoming parameters, for the upstream
+// they name.
+func (s *Server) newAPIRequest(url string, params map[string]string) *apicache.Request {
+	apireq := s.getUpstream(params["upstream"]).client.NewRequest(url)
+	for k, v := range params {
+		switch k {
+		case "force":
+			if v != "" {
+				apireq.Force = true
+			}
+		default:
+			if !proxyParams[k] {
+				apireq.Set(k, v)
+			}
+		}
+	}
+	return apireq
+}
+
+// What the workers know about a request besides the apicache request itself.
+type apiCall struct {
+	url      string
+	params   map[string]string
+	upstream *upstream
+}
+
+// Takes what's needed from the incoming parameters, leaving out the proxy's
+// own. Safe to hand to other goroutines.
+func (s *Server) newAPICall(url string, params map[string]string) apiCall {
+	call := apiCall{
+		url:      url,
+		params:   make(map[string]string),
+		upstream: s.getUpstream(params["upstream"]),
+	}
+	for k, v := range params {
+		if !proxyParams[k] {
+			call.params[k] = v
+		}
+	}
+	return call
+}
+
+// The tag the call's response is stored under in the cache backend.
+func (c apiCall) tag() string {
+	return namespaceTag(c.upstream.name, cacheTag(c.url, c.params))
+}
+
+// Describes the call for storing with its response, see cacheKey.
+func (c apiCall) key() string {
+	return cacheKey(c.upstream.name, c.url, c.params)
+}
+
+// Sends a request through the worker pool in the given priority class,
+// retrying on server issues. Returns the response along with the ID of the
+// worker that handled it, the number of retries and time spent upstream.
+func (s *Server) fetchAPI(apireq *apicache.Request, call apiCall, class int) (*apicache.Response, fetchInfo, error) {
+	var apiResp *apicache.Response
+	var err error
+	var info fetchInfo
+
+	retries := s.getConf().Retries
+	for i := 0; i < retries; i++ {
+		if i > 0 {
+			s.metrics.retries.Inc()
+			info.retries = i
+		}
+
+		respChan := make(chan apiReq)
+		req := apiReq{apiReq: apireq, call: call, respChan: respChan}
+		err = s.workQueue.Push(class, req)
+		if err != nil {
+			return unavailableResponse(), info, err
+		}
+
+		resp := <-respChan
+		close(respChan)
+
+		apiResp = resp.apiResp
+		err = resp.err
+		info.workerID = fmt.Sprintf("%d", resp.worker)
+		info.latency += resp.latency
+
+		// Attempt to recover from server issues, invalidate flag means we
+		// believe this is not a server failure.
+		// 418 is the tempban code
+		// 500/900 are panic codes
+		if err == nil || apiResp.Invalidate || apiResp.HTTPCode == 418 || apiResp.HTTPCode == 500 || apiResp.HTTPCode == 900 {
+			break
+		}
+		time.Sleep(2 * time.Second)
+		apireq.Force = true
+	}
+
+	return apiResp, info, err
+}
+
+// Builds the response given when there are no workers to send a request to,
+// before Start or after Shutdown.
+func unavailableResponse() *apicache.Response {
+	errStr := "APIProxy Error: Proxy is not running."
+	return &apicache.Response{
+		Data:     apicache.SynthesizeAPIError(503, errStr, time.Minute),
+		Expires:  time.Now().Add(time.Minute),
+		Error:    apicache.APIError{ErrorCode: 503, ErrorText: errStr},
+		HTTPCode: 503,
+	}
+}
+
+// APIReq answers a request for an API page from the cache, or sends it
+// through the worker pool to the API.
+func (s *Server) APIReq(url string, params map[string]string) (*apicache.Response, error) {
+	resp, _, err := s.apiReq(url, params)
+	return resp, err
+}
+
+// Does the work of APIReq, also telling how the request was answered.
+func (s *Server) apiReq(url string, params map[string]string) (*apicache.Response, reqResult, error) {
+	var errorStr string
+	conf := s.getConf()
+
+	if atomic.LoadInt32(&s.workerCount) <= 0 {
+		return unavailableResponse(), reqResult{}, fmt.Errorf("No workers running")
+	}
+
+	// Build the request
+	apireq := s.newAPIRequest(url, params)
+
+	workerID := "C"
+	// Don't send it to a worker if we can just yank it fromm the cache
+	apiResp, err := apireq.GetCached()
+
+	// The cache hands back expired entries within the stale windows, either
+	// serve it now and refresh behind the scenes or keep it around in case
+	// the API fails us.
+	var stale *apicache.Response
+	var info fetchInfo
+	cacheStatus := "hit"
+	switch {
+	case err != nil || apireq.Force:
+		cacheStatus = "miss"
+	case isStale(apiResp):
+		cacheStatus = "stale"
+	}
+	s.metrics.cache.Inc(cacheStatus)
+	if err == nil && !apireq.Force && isStale(apiResp) {
+		if canServeStale(apiResp, conf.StaleWhileRevalidate) {
+			atomic.AddInt64(&s.staleCount, 1)
+			s.refreshInBackground(url, params)
+			workerID = "S"
+		} else {
+			stale = apiResp
+			apireq.Force = true
+		}
+	}
+
+	if err != nil || apireq.Force {
+		// Identical requests share a single trip through the worker pool,
+		// which is charged to the client of the request making it.
+		cl := s.getClientLimits(conf, params["client"])
+		apiResp, info, err = s.coalesce(requestTag(url, params), func() (*apicache.Response, fetchInfo, error) {
+			if cl != nil {
+				quotaResp := cl.start(time.Duration(conf.Quota.Timeout) * time.Second)
+				if quotaResp != nil {
+					return quotaResp, fetchInfo{workerID: "Q"}, errOverQuota
+				}
+			}
+			resp, info, err := s.fetchAPI(apireq, s.newAPICall(url, params), s.workQueue.class(params["priority"]))
+			if cl != nil {
+				cl.finish(resp)
+			}
+			return resp, info, err
+		})
+		workerID = info.workerID
+		if err == errOverQuota {
+			err = nil
+			cacheStatus = "quota"
+		}
+
+		if stale != nil && upstreamFailed(apiResp, err) && canServeStale(stale, conf.StaleIfError) {
+			s.debugLog.Printf("Serving stale data for %s after upstream failure: %v", url, err)
+			atomic.AddInt64(&s.staleErrorCount, 1)
+			apiResp, err = stale, nil
+			workerID = "S"
+			cacheStatus = "stale-error"
+		}
+	}
+
+	s.warmer.track(url, params, apiResp)
+
+	// I HATE 221 HATE HATE HAAAAAAAATE
+	var singleDebug bool
+	if apiResp.Error.ErrorCode == 221 {
+		singleDebug = true
+	}
+
+	// This is similar to the request log, but knows more about where it came from.
+	if conf.Logging.Debug || singleDebug {
+		if apiResp.Error.ErrorCode != 0 {
+			errorStr = fmt.Sprintf(" Error %d: %s", apiResp.Error.ErrorCode, apiResp.Error.ErrorText)
+		}
+		s.debugLog.Printf("w%s: %s%s HTTP: %d Expires: %s%s", workerID, url, formatLogParams(params, conf.Logging.CensorLog), apiResp.HTTPCode, apiResp.Expires.Format("2006-01-02 15:04:05"), errorStr)
+	}
+
+	info.workerID = workerID
+	return apiResp, reqResult{cacheStatus, info}, err
+}
+
+// Runs jobs from the queue until it's closed or the worker is retired. The
+// worker must already be counted in workerCount.
+func (s *Server) worker(queue *priorityQueue, workerID int) {
+	for {
+		req, ok := queue.Pop()
+		if !ok {
+			break
+		}
+
+		var err, eErr, rErr error
+		var errStr string
+
+		atomic.AddInt32(&s.activeWorkerCount, 1)
+		rateLimiter, errorRateLimiter := s.upstreamLimiters(req.call.upstream)
+
+		// Run both of the error limiters simultaneously rather than in
+		// sequence. Still need both before we continue.
+		limitStart := time.Now()
+		errorLimiter := make(chan error)
+		rpsLimiter := make(chan error)
+		go func() {
+			err := errorRateLimiter.Start(30 * time.Second)
+			errorLimiter <- err
+		}()
+		go func() {
+			err := rateLimiter.Start(30 * time.Second)
+			rpsLimiter <- err
+		}()
+		eErr = <-errorLimiter
+		rErr = <-rpsLimiter
+		s.metrics.rateLimitWait.ObserveSince(limitStart)
+
+		// Check the error limiter for timeouts
+		if eErr != nil {
+			err = eErr
+			errStr = "error throttling"
+			s.metrics.rateLimitTimeouts.Inc("errors")
+
+			// If the rate limiter didn't timeout be sure to signal it that we
+			// didn't do anything.
+			if rErr == nil {
+				rateLimiter.Finish(true)
+			}
+		}
+		if rErr != nil {
+			err = rErr
+			s.metrics.rateLimitTimeouts.Inc("requests")
+			if errStr == "" {
+				errStr = "rate limiting"
+			} else {
+				errStr += " and rate limiting"
+			}
+
+			// If the error limiter didn't also timeout be sure to signal it that we
+			// didn't do anything.
+			if eErr == nil {
+				errorRateLimiter.Finish(true)
+			}
+		}
+		// We're left with a single err and errStr for returning an error to the client.
+		if err != nil {
+			s.log.Printf("Rate Limit Error: %s - %s", errStr, err)
+			s.log.Printf("RPS Events: %d Outstanding: %d", rateLimiter.Count(), rateLimiter.Outstanding())
+			s.log.Printf("Errors Events: %d Outstanding: %d", errorRateLimiter.Count(), errorRateLimiter.Outstanding())
+
+			req.apiResp = &apicache.Response{
+				Data: apicache.SynthesizeAPIError(500,
+					fmt.Sprintf("APIProxy Error: Proxy timeout due to %s.", errStr),
+					5*time.Minute),
+				Expires: time.Now().Add(5 * time.Minute),
+				Error: apicache.APIError{500,
+					fmt.Sprintf("APIProxy Error: Proxy timeout due to %s.", errStr)},
+				HTTPCode: 504,
+			}
+			req.err = err
+		} else {
+			upstreamStart := time.Now()
+			var resp *apicache.Response
+			if s.replayer != nil {
+				resp, err = s.replay(req.call)
+			} else {
+				// apicache stores the response before handing it back.
+				done := s.storeKeys.expect(req.call.tag(), req.call.key())
+				resp, err = req.apiReq.Do()
+				done()
+			}
+			req.latency = time.Since(upstreamStart)
+			s.metrics.upstreamLatency.Observe(req.latency.Seconds())
+			if s.recorder != nil {
+				s.recorder.record(req.call, resp, err, req.latency)
+			}
+			req.apiResp = resp
+			req.err = err
+			if resp.Error.ErrorCode == 0 || resp.HTTPCode == 504 || resp.HTTPCode == 418 {
+				// 418 means we are currently tempbanned from the API.
+				// 504 means the API proxy had some kind of internal or network error.
+				//
+				// We do not treat these as an error for rate limiting because
+				// the apicache library handles it for us, these requests are
+				// not actually making it to the CCP API.
+
+				// Finish, but skip recording the event in the rate limiter
+				// when there is no error.
+				errorRateLimiter.Finish(true)
+			} else {
+				errorRateLimiter.Finish(false)
+			}
+			rateLimiter.Finish(false)
+		}
+
+		req.worker = workerID
+		req.respChan <- req
+		s.workCountLock.RLock()
+		atomic.AddInt32(&s.workCount[workerID], 1)
+		s.workCountLock.RUnlock()
+		atomic.AddInt32(&s.activeWorkerCount, -1)
+	}
+	atomic.AddInt32(&s.workerCount, -1)
+}
+
+func (s *Server) startWorkers() {
+	workers := s.getConf().Workers
+	s.log.Printf("Starting %d Workers...", workers)
+	s.resizeWorkers(workers)
+}
+
+// Grows or shrinks the worker pool. Workers let go finish their current job
+// first, new workers get fresh IDs so their job counts start from zero.
+func (s *Server) resizeWorkers(n int) {
+	s.workCountLock.Lock()
+	defer s.workCountLock.Unlock()
+
+	if n < s.workerTarget {
+		s.workQueue.Retire(s.workerTarget - n)
+	} else if n > s.workerTarget {
+		start := s.workQueue.Unretire(n - s.workerTarget)
+		for i := start; i < n-s.workerTarget; i++ {
+			workerID := len(s.workCount)
+			s.workCount = append(s.workCount, 0)
+			s.debugLog.Printf("Starting worker #%d.", workerID)
+			atomic.AddInt32(&s.workerCount, 1)
+			go s.worker(s.workQueue, workerID)
+		}
+	}
+	s.workerTarget = n
+}
+
+// Returns the number of jobs handled by each worker, indexed by worker ID.
+func (s *Server) getWorkCounts() []int32 {
+	s.workCountLock.RLock()
+	defer s.workCountLock.RUnlock()
+
+	counts := make([]int32, len(s.workCount))
+	for i := range s.workCount {
+		counts[i] = atomic.LoadInt32(&s.workCount[i])
+	}
+	return counts
+}
+
+// Lets the workers finish what's already queued and waits for them to stop,
+// giving up once ctx is done. Returns false if any were still working.
+func (s *Server) stopWorkers(ctx context.Context) bool {
+	s.workQueue.Close()
+
+	for atomic.LoadInt32(&s.workerCount) > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+func (s *Server) PrintWorkerStats(w io.Writer) {
+	active, loaded := s.GetWorkerStats()
+	fmt.Fprintf(w, "%d workers idle, %d workers active.\n", loaded-active, active)
+
+	rateLimiter, errorRateLimiter := s.getLimiters()
+	rateCount := rateLimiter.Count()
+	rateOutstanding := rateLimiter.Outstanding()
+
+	errorCount := errorRateLimiter.Count()
+	errorOutstanding := errorRateLimiter.Outstanding()
+
+	fmt.Fprintf(w, "%d requests in the last second. %d requests outstanding.\n", rateCount, rateOutstanding)
+	fmt.Fprintf(w, "%d errors over last %d seconds. %d errors outstanding.\n", errorCount, s.getConf().ErrorPeriod, errorOutstanding)
+	fmt.Fprintf(w, "%d requests coalesced with identical requests in flight.\n", atomic.LoadInt64(&s.coalescedCount))
+
+	s.workQueue.LogStats(w)
+
+	counts := s.getWorkCounts()
+	for i := 1; i < len(counts); i++ {
+		fmt.Fprintf(w, "   %d: %d\n", i, counts[i])
+	}
+}
+
+func (s *Server) GetWorkerStats() (int32, int32) {
+	return atomic.LoadInt32(&s.activeWorkerCount), atomic.LoadInt32(&s.workerCount)
+}